@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/wire"
+)
+
+// accessLogger, if set, logs every request from cmd/go; see -access-log.
+var accessLogger *accessLog
+
+// accessLog writes an accessRecord per request as JSON Lines. It appends, so one file can collect several runs.
+type accessLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func openAccessLog(file string) (*accessLog, error) {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLog{f: f}, nil
+}
+
+// accessRecord is a line of the access log. It rides along in the request's context so that the tiers can fill it in.
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	ID       int64     `json:"id"`
+	Command  string    `json:"command"`
+	ActionID string    `json:"actionID,omitempty"`
+	OutputID string    `json:"outputID,omitempty"`
+	Size     int64     `json:"size"`
+	Miss     bool      `json:"miss,omitempty"`
+	// Tier is the tier that served a get
+	Tier    string  `json:"tier,omitempty"`
+	Seconds float64 `json:"seconds"`
+	// TierSeconds is the time spent in each tier
+	TierSeconds  map[string]float64 `json:"tierSeconds,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	UploadQueued bool               `json:"uploadQueued,omitempty"`
+}
+
+type accessRecordKey struct{}
+
+// accessRecordFrom returns the access record of the request ctx is for, or nil if there's none.
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	r, _ := ctx.Value(accessRecordKey{}).(*accessRecord)
+	return r
+}
+
+// noteTierLatency adds d to the time spent in tier by the request ctx is for.
+func noteTierLatency(ctx context.Context, tier string, d time.Duration) {
+	r := accessRecordFrom(ctx)
+	if r == nil {
+		return
+	}
+	if r.TierSeconds == nil {
+		r.TierSeconds = make(map[string]float64)
+	}
+	r.TierSeconds[tier] += d.Seconds()
+}
+
+// noteUploadQueued records that the request ctx is for queued an upload to S3.
+func noteUploadQueued(ctx context.Context) {
+	if r := accessRecordFrom(ctx); r != nil {
+		r.UploadQueued = true
+	}
+}
+
+// startRequest is a cacheproc.Process StartRequest that logs the request once it's handled.
+func (l *accessLog) startRequest(ctx context.Context, req *wire.Request) (context.Context, func(*wire.Response, error)) {
+	start := time.Now()
+	r := &accessRecord{
+		Time:    start,
+		ID:      req.ID,
+		Command: string(req.Command),
+	}
+	if req.ActionID != nil {
+		r.ActionID = fmt.Sprintf("%x", req.ActionID)
+	}
+	if req.Command == wire.CmdPut {
+		r.OutputID = fmt.Sprintf("%x", req.OutputID)
+		r.Size = req.BodySize
+	}
+	return context.WithValue(ctx, accessRecordKey{}, r), func(res *wire.Response, err error) {
+		r.Seconds = time.Since(start).Seconds()
+		if req.Command == wire.CmdGet {
+			r.Miss = res.Miss
+			if !res.Miss && err == nil {
+				r.OutputID = fmt.Sprintf("%x", res.OutputID)
+				r.Size = res.Size
+			}
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		if err := l.write(r); err != nil {
+			slog.Warn("failed to write access log", "err", err)
+		}
+	}
+}
+
+func (l *accessLog) write(r *accessRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// one write per line, so that lines from processes sharing the file don't interleave
+	_, err = l.f.Write(append(b, '\n'))
+	return err
+}
+
+func (l *accessLog) Close() error {
+	return l.f.Close()
+}
+
+// chainStartRequest combines cacheproc.Process StartRequest funcs, calling them in order and their done funcs in
+// reverse order. It returns nil if there are none.
+func chainStartRequest(fns ...func(context.Context, *wire.Request) (context.Context, func(*wire.Response, error))) func(context.Context, *wire.Request) (context.Context, func(*wire.Response, error)) {
+	if len(fns) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, req *wire.Request) (context.Context, func(*wire.Response, error)) {
+		dones := make([]func(*wire.Response, error), len(fns))
+		for i, fn := range fns {
+			ctx, dones[i] = fn(ctx, req)
+		}
+		return ctx, func(res *wire.Response, err error) {
+			for i := len(dones) - 1; i >= 0; i-- {
+				dones[i](res, err)
+			}
+		}
+	}
+}
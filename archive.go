@@ -0,0 +1,559 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// An archive is a zstd-compressed tar of cache entries, for moving them somewhere export and import can't reach S3
+// from, like an air-gapped build. Each action is a file actions/<actionID> holding its output, with the time from its
+// index entry as its mtime and the rest in PAX records. The manifest comes last, so that import can tell a truncated
+// archive from a complete one.
+const (
+	archiveActionsDir   = "actions/"
+	archiveManifestName = "manifest.json"
+	archiveVersion      = 1
+
+	paxOutputID = "GOCACHEPROG.outputid"
+	paxOrigin   = "GOCACHEPROG.origin"
+	paxETag     = "GOCACHEPROG.etag"
+)
+
+// archiveManifest describes what's in an archive.
+type archiveManifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Source is where the entries came from: a disk cache dir or an s3:// URL
+	Source  string         `json:"source"`
+	Bytes   int64          `json:"bytes"`
+	Actions []archiveEntry `json:"actions"`
+}
+
+type archiveEntry struct {
+	ActionID string    `json:"actionID"`
+	OutputID string    `json:"outputID"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// archiveWriter writes an archive. Close writes the manifest.
+type archiveWriter struct {
+	zw       io.WriteCloser
+	tw       *tar.Writer
+	manifest archiveManifest
+}
+
+func newArchiveWriter(w io.Writer, source string) (*archiveWriter, error) {
+	zw, err := CompressionZstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveWriter{
+		zw:       zw,
+		tw:       tar.NewWriter(zw),
+		manifest: archiveManifest{Version: archiveVersion, Created: time.Now().UTC(), Source: source, Actions: []archiveEntry{}},
+	}, nil
+}
+
+// add writes the entry ie for actionID, with its output read from body.
+func (a *archiveWriter) add(actionID string, ie indexEntry, body io.Reader) error {
+	t := time.Unix(0, ie.TimeNanos)
+	hdr := &tar.Header{
+		Name:    archiveActionsDir + actionID,
+		Mode:    0644,
+		Size:    ie.Size,
+		ModTime: t,
+		// PAX keeps the nanoseconds of the mtime
+		Format:     tar.FormatPAX,
+		PAXRecords: map[string]string{paxOutputID: ie.OutputID},
+	}
+	if ie.Origin != "" {
+		hdr.PAXRecords[paxOrigin] = ie.Origin
+	}
+	if ie.ETag != "" {
+		hdr.PAXRecords[paxETag] = ie.ETag
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(a.tw, newHashCheckReader(body, ie.OutputID)); err != nil {
+		return fmt.Errorf("%s: %w", actionID, err)
+	}
+	a.manifest.Bytes += ie.Size
+	a.manifest.Actions = append(a.manifest.Actions, archiveEntry{ActionID: actionID, OutputID: ie.OutputID, Size: ie.Size, Time: t.UTC()})
+	return nil
+}
+
+func (a *archiveWriter) Close() error {
+	mj, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = a.tw.WriteHeader(&tar.Header{Name: archiveManifestName, Mode: 0644, Size: int64(len(mj)), ModTime: a.manifest.Created})
+	if err == nil {
+		_, err = a.tw.Write(mj)
+	}
+	if err == nil {
+		err = a.tw.Close()
+	}
+	if closeErr := a.zw.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readArchive calls fn with each entry in the archive r, and its output. The output fails to read to the end if it
+// doesn't match its outputID. It returns the manifest, or an error if there isn't one or it doesn't match the entries.
+func readArchive(r io.Reader, fn func(actionID string, ie indexEntry, body io.Reader) error) (*archiveManifest, error) {
+	zr, err := CompressionZstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	var manifest *archiveManifest
+	n := 0
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == archiveManifestName {
+			manifest = new(archiveManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("reading manifest: %w", err)
+			}
+			continue
+		}
+		actionID, ok := strings.CutPrefix(hdr.Name, archiveActionsDir)
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		ie := indexEntry{
+			Version:   1,
+			OutputID:  hdr.PAXRecords[paxOutputID],
+			Size:      hdr.Size,
+			TimeNanos: hdr.ModTime.UnixNano(),
+			Origin:    hdr.PAXRecords[paxOrigin],
+			ETag:      hdr.PAXRecords[paxETag],
+		}
+		if !validID(actionID) || !validID(ie.OutputID) {
+			return nil, fmt.Errorf("bad entry %s (outputID %q)", hdr.Name, ie.OutputID)
+		}
+		body := newHashCheckReader(tr, ie.OutputID)
+		if err := fn(actionID, ie, body); err != nil {
+			return nil, err
+		}
+		// in case fn didn't read it all, e.g. because it already had it
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return nil, fmt.Errorf("%s: %w", actionID, err)
+		}
+		n++
+	}
+	if manifest == nil {
+		return nil, errors.New("archive has no manifest; is it truncated?")
+	}
+	if len(manifest.Actions) != n {
+		return nil, fmt.Errorf("archive has %d entries, but its manifest lists %d", n, len(manifest.Actions))
+	}
+	return manifest, nil
+}
+
+// hashCheckReader reads an output, failing at the end if it doesn't hash to outputID (when that's [verifiable]).
+type hashCheckReader struct {
+	r        io.Reader
+	h        hash.Hash
+	outputID string
+}
+
+func newHashCheckReader(r io.Reader, outputID string) *hashCheckReader {
+	return &hashCheckReader{r: r, h: sha256.New(), outputID: outputID}
+}
+
+func (r *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	if errors.Is(err, io.EOF) && verifiable(r.outputID) {
+		if sum := hex.EncodeToString(r.h.Sum(nil)); sum != r.outputID {
+			return n, fmt.Errorf("contents hash to %s, not outputID %s", sum, r.outputID)
+		}
+	}
+	return n, err
+}
+
+// exportFilter picks the entries to export: those in actionIDs (if set), put or filled since since (if set).
+type exportFilter struct {
+	actionIDs map[string]bool
+	since     time.Time
+}
+
+func (f exportFilter) keep(actionID string, t time.Time) bool {
+	if f.actionIDs != nil && !f.actionIDs[actionID] {
+		return false
+	}
+	return f.since.IsZero() || !t.Before(f.since)
+}
+
+// Export adds the entries in the disk cache that f keeps to a. It skips entries whose output is missing.
+func (c *DiskCache) Export(a *archiveWriter, f exportFilter) error {
+	return c.walkEntries(func(actionID string, ie indexEntry) error {
+		if !f.keep(actionID, time.Unix(0, ie.TimeNanos)) {
+			return nil
+		}
+		r, err := c.openOutput(ie.OutputID)
+		if os.IsNotExist(err) {
+			c.log.Debug("export: output missing", "actionID", actionID, "outputID", ie.OutputID)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer r.Close()
+		return a.add(actionID, ie, r)
+	})
+}
+
+// openOutput opens the output file for outputID, hot or cold, without bumping its mtime or decompressing it to disk.
+func (c *DiskCache) openOutput(outputID string) (io.ReadCloser, error) {
+	// so it isn't compressed or decompressed between our tries; once it's open, it doesn't matter
+	unlock, err := c.lock("o-" + outputID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionGzip} {
+		f, err := os.Open(c.outputFile(outputID) + compression.Ext())
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		r, err := compression.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &decompressReadCloser{ReadCloser: r, body: f}, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Import puts the entries in the archive r into the disk cache, keeping their times, unless it already has them. They
+// count as built locally, so they're uploaded to S3 like any other.
+func (c *DiskCache) Import(r io.Reader) (ImportResult, error) {
+	var res ImportResult
+	_, err := readArchive(r, func(actionID string, ie indexEntry, body io.Reader) error {
+		res.Entries++
+		unlock, err := c.lock("a-" + actionID)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		if have, ok := c.entry(actionID); ok && have.OutputID == ie.OutputID {
+			if out, err := c.openOutput(ie.OutputID); err == nil {
+				out.Close()
+				res.Present++
+				return nil
+			}
+		}
+		// outputs are shared, so a later put of another action that has it wins
+		t := time.Unix(0, ie.TimeNanos)
+		for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionGzip} {
+			if fi, err := os.Stat(c.outputFile(ie.OutputID) + compression.Ext()); err == nil && fi.ModTime().After(t) {
+				t = fi.ModTime()
+			}
+		}
+		// this cache didn't fill it, so it uploads it like anything it built
+		ie.Origin, ie.ETag = originLocal, ""
+		if err := c.putEntry(actionID, ie, body); err != nil {
+			return fmt.Errorf("importing %s: %w", actionID, err)
+		}
+		// cmd/go takes the output's mtime as the time of the put, so it has to be that, not now
+		if err := c.setOutputTime(ie.OutputID, t); err != nil {
+			return fmt.Errorf("importing %s: %w", actionID, err)
+		}
+		res.Imported++
+		res.Bytes += ie.Size
+		return nil
+	})
+	return res, err
+}
+
+// setOutputTime sets the mtime of the output file for outputID to t.
+func (c *DiskCache) setOutputTime(outputID string, t time.Time) error {
+	unlock, err := c.lock("o-" + outputID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return os.Chtimes(c.outputFile(outputID), t, t)
+}
+
+// Export adds the action objects in S3 (listed with up to parallel listings at once) that f keeps to a, in key order.
+// Their times are as in [objectTime]. It doesn't need [Start].
+func (c *DiskAsyncS3Cache) Export(ctx context.Context, a *archiveWriter, parallel int, f exportFilter) error {
+	var objects []remoteObject
+	var mu sync.Mutex
+	err := c.listActions(ctx, parallel, func(o remoteObject) error {
+		// the time in the metadata is never after LastModified, so this only lets through too many
+		if !f.keep(path.Base(o.Key), o.LastModified) {
+			return nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		objects = append(objects, o)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(objects, func(a, b remoteObject) int { return strings.Compare(a.Key, b.Key) })
+	for _, o := range objects {
+		actionID := path.Base(o.Key)
+		obj, err := c.s3Get(ctx, actionID)
+		if err != nil {
+			return err
+		}
+		if obj == nil {
+			// deleted since we listed it
+			continue
+		}
+		if !f.keep(actionID, obj.Time) {
+			obj.Body.Close()
+			continue
+		}
+		ie := indexEntry{
+			Version:   1,
+			OutputID:  obj.OutputID,
+			Size:      obj.Size,
+			TimeNanos: obj.Time.UnixNano(),
+			Origin:    originRemote,
+			ETag:      obj.ETag,
+		}
+		err = a.add(actionID, ie, obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importPath is where import markers live under the s3 prefix. An import marker lists the actionIDs an import
+// uploaded, whose put times (in their metadata) may be long before their LastModified; gc only heads those.
+const importPath = "_imports"
+
+// Import uploads the entries in the archive r to S3, up to parallel at once, unless they're already there. Their times
+// are kept in the objects' metadata, and the uploaded actionIDs in an import marker. It doesn't need [Start].
+func (c *DiskAsyncS3Cache) Import(ctx context.Context, r io.Reader, parallel int) (ImportResult, error) {
+	var res ImportResult
+	var imported []string
+	var mu sync.Mutex
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(parallel, 1))
+	_, err := readArchive(r, func(actionID string, ie indexEntry, body io.Reader) error {
+		if err := gctx.Err(); err != nil {
+			// an upload failed; g.Wait has the error
+			return err
+		}
+		// the tar has to be read in order, so spool the output to upload it in the background
+		f, err := os.CreateTemp("", "gocacheprog-import-*")
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, body); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return fmt.Errorf("%s: %w", actionID, err)
+		}
+		g.Go(func() error {
+			defer os.Remove(f.Name())
+			defer f.Close()
+			exists, err := c.s3Exists(gctx, actionID)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+				if err := c.s3Put(gctx, actionID, ie.OutputID, ie.Size, time.Unix(0, ie.TimeNanos), f); err != nil {
+					return fmt.Errorf("uploading %s: %w", actionID, err)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if exists {
+				res.Present++
+			} else {
+				res.Imported++
+				res.Bytes += ie.Size
+				imported = append(imported, actionID)
+			}
+			return nil
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		res.Entries++
+		return nil
+	})
+	if werr := g.Wait(); werr != nil {
+		err = werr
+	}
+	// even after a failure, so gc knows about the ones that made it
+	if len(imported) > 0 {
+		if merr := c.putActionIDs(ctx, c.markerKey(importPath, time.Now()), imported); merr != nil && err == nil {
+			err = fmt.Errorf("putting import marker: %w", merr)
+		}
+	}
+	return res, err
+}
+
+// ImportResult counts what an import did.
+type ImportResult struct {
+	Entries  int64
+	Imported int64
+	Present  int64
+	Bytes    int64
+}
+
+// runExport implements the export subcommand, which packs entries from the disk cache or S3 into an archive.
+func runExport(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	from := fs.String("from", "disk", "where to export entries from: disk or s3")
+	out := fs.String("o", "", "archive file to write (- for stdout)")
+	actions := fs.String("actions", "", "only export the actionIDs in this file, one per line (e.g. a manifest)")
+	since := fs.Duration("since", 0, "only export entries put or filled (on disk) or uploaded (to s3) this recently (0=all)")
+	parallel := fs.Int("parallel", 16, "number of s3 listings to run at once")
+	fs.Parse(args)
+	if *out == "" {
+		return errors.New("export: -o is required")
+	}
+
+	var f exportFilter
+	if *actions != "" {
+		af, err := os.Open(*actions)
+		if err != nil {
+			return err
+		}
+		actionIDs, err := readActionIDs(af)
+		af.Close()
+		if err != nil {
+			return err
+		}
+		f.actionIDs = make(map[string]bool, len(actionIDs))
+		for _, actionID := range actionIDs {
+			f.actionIDs[actionID] = true
+		}
+	}
+	if *since > 0 {
+		f.since = time.Now().Add(-*since)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "-" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	var a *archiveWriter
+	var err error
+	switch *from {
+	case "disk":
+		// for the locks dir
+		if err := cacher.diskCache.Start(ctx); err != nil {
+			return err
+		}
+		defer cacher.diskCache.Close()
+		if a, err = newArchiveWriter(w, cacher.diskCache.dir); err != nil {
+			return err
+		}
+		err = cacher.diskCache.Export(a, f)
+	case "s3":
+		if a, err = newArchiveWriter(w, fmt.Sprintf("s3://%s/%s", cacher.bucketName, cacher.s3Prefix)); err != nil {
+			return err
+		}
+		err = cacher.Export(ctx, a, *parallel, f)
+	default:
+		return fmt.Errorf("export: unknown source %q (want disk or s3)", *from)
+	}
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	if err := a.Close(); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "export: %d entries, %s\n", len(a.manifest.Actions), formatBytes(float64(a.manifest.Bytes)))
+	return nil
+}
+
+// runImport implements the import subcommand, which unpacks an archive into the disk cache or S3.
+func runImport(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	to := fs.String("to", "disk", "where to import entries to: disk or s3")
+	parallel := fs.Int("parallel", 16, "number of s3 uploads to run at once")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: import [flags] <archive>\n\narchive is from export, or - for stdin.\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("import: want one archive")
+	}
+
+	r := io.Reader(os.Stdin)
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	var res ImportResult
+	var err error
+	switch *to {
+	case "disk":
+		if err := cacher.diskCache.Start(ctx); err != nil {
+			return err
+		}
+		defer cacher.diskCache.Close()
+		res, err = cacher.diskCache.Import(r)
+	case "s3":
+		// for the temp files of compressed uploads
+		if err := cacher.diskCache.Start(ctx); err != nil {
+			return err
+		}
+		defer cacher.diskCache.Close()
+		res, err = cacher.Import(ctx, r, *parallel)
+	default:
+		return fmt.Errorf("import: unknown destination %q (want disk or s3)", *to)
+	}
+	fmt.Fprintf(os.Stderr, "import: %d entries, %d already there, %d imported (%s)\n", res.Entries, res.Present, res.Imported,
+		formatBytes(float64(res.Bytes)))
+	if err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+	return nil
+}
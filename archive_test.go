@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportArchive exports every entry in dc to an archive.
+func exportArchive(t *testing.T, dc *DiskCache) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	a, err := newArchiveWriter(&buf, dc.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Export(a, exportFilter{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func startedDiskCache(t *testing.T) *DiskCache {
+	t.Helper()
+	dc := NewDiskCache(t.TempDir())
+	if err := dc.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dc.Close() })
+	return dc
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	id := func(i int) string { return fmt.Sprintf("%064x", i) }
+	src := startedDiskCache(t)
+	put := time.Now().Add(-48 * time.Hour).Truncate(time.Microsecond)
+	entries := map[string][]byte{id(1): []byte("one"), id(2): nil, id(3): bytes.Repeat([]byte("three"), 1000)}
+	for actionID, body := range entries {
+		outputID, size := outputOf(t, body)
+		// filled from S3, as far as src knows
+		ie := indexEntry{Version: 1, OutputID: outputID, Size: size, TimeNanos: put.UnixNano(), Origin: originRemote, ETag: `"etag"`}
+		if err := src.putEntry(actionID, ie, bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive := exportArchive(t, src)
+
+	dst := startedDiskCache(t)
+	res, err := dst.Import(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Entries != 3 || res.Imported != 3 || res.Bytes != 3+5000 {
+		t.Errorf("got %+v, want 3 entries imported, 5003 bytes", res)
+	}
+	for actionID, body := range entries {
+		ie, ok := dst.entry(actionID)
+		if !ok {
+			t.Fatalf("%s not imported", actionID)
+		}
+		if ie.Origin != originLocal || ie.ETag != "" {
+			t.Errorf("%s: origin %q, ETag %q; want it local, so it's uploaded", actionID, ie.Origin, ie.ETag)
+		}
+		if ie.TimeNanos != put.UnixNano() {
+			t.Errorf("%s: index time %v, want %v", actionID, time.Unix(0, ie.TimeNanos), put)
+		}
+		fi, err := os.Stat(dst.outputFile(ie.OutputID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(put) {
+			t.Errorf("%s: output mtime %v, want the put time %v", actionID, fi.ModTime(), put)
+		}
+		got, err := os.ReadFile(dst.outputFile(ie.OutputID))
+		if err != nil || !bytes.Equal(got, body) {
+			t.Errorf("%s: output %q, %v; want %q", actionID, got, err, body)
+		}
+	}
+
+	res, err = dst.Import(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Present != 3 || res.Imported != 0 {
+		t.Errorf("importing again: got %+v, want all 3 present", res)
+	}
+}
+
+func TestArchiveTruncated(t *testing.T) {
+	src := startedDiskCache(t)
+	body := bytes.Repeat([]byte("output"), 1000)
+	outputID, size := outputOf(t, body)
+	ie := indexEntry{Version: 1, OutputID: outputID, Size: size, TimeNanos: time.Now().UnixNano()}
+	if err := src.putEntry(fmt.Sprintf("%064x", 1), ie, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	archive := exportArchive(t, src)
+
+	for _, n := range []int{0, len(archive) / 2, len(archive) - 1} {
+		_, err := startedDiskCache(t).Import(bytes.NewReader(archive[:n]))
+		if err == nil {
+			t.Errorf("imported an archive truncated to %d of %d bytes", n, len(archive))
+		}
+	}
+}
+
+func TestArchiveTampered(t *testing.T) {
+	src := startedDiskCache(t)
+	body := []byte("the real output")
+	outputID, size := outputOf(t, body)
+	ie := indexEntry{Version: 1, OutputID: outputID, Size: size, TimeNanos: time.Now().UnixNano()}
+	if err := src.putEntry(fmt.Sprintf("%064x", 1), ie, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	archive := exportArchive(t, src)
+
+	// swap the output for another of the same size, leaving the tar otherwise intact
+	zr, err := CompressionZstd.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	zr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(raw, body) {
+		t.Fatal("output not found in the tar")
+	}
+	raw = bytes.Replace(raw, body, []byte("a fake output!!"), 1)
+	if _, err := tar.NewReader(bytes.NewReader(raw)).Next(); err != nil {
+		t.Fatalf("tampered tar doesn't read: %v", err)
+	}
+	var buf bytes.Buffer
+	zw, err := CompressionZstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(raw)
+	zw.Close()
+
+	dst := startedDiskCache(t)
+	_, err = dst.Import(&buf)
+	if err == nil || !strings.Contains(err.Error(), "contents hash to") {
+		t.Fatalf("importing a tampered archive: got %v, want a hash mismatch", err)
+	}
+	if _, ok := dst.entry(fmt.Sprintf("%064x", 1)); ok {
+		t.Error("tampered entry was imported")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// BackfillOptions configures [DiskAsyncS3Cache.Backfill].
+type BackfillOptions struct {
+	// DryRun only reports what's missing from S3, without uploading anything.
+	DryRun bool
+	// RateLimit is the max number of entries checked in S3 (and so uploaded) per second (0=unlimited).
+	RateLimit float64
+}
+
+// BackfillResult counts what a backfill found.
+type BackfillResult struct {
+	Scanned int
+	Missing int
+	Queued  int
+}
+
+// Backfill uploads the entries in the disk cache that are missing from S3, which happens when the disk and S3 get out of
+// sync (e.g. a failed upload, a disk cache populated without S3, or an object deleted by gc or verify). It walks the disk
+// cache's index, checks each action that isn't known to be in S3 with a HeadObject, and queues the missing ones for the
+// regular upload workers, which read cold outputs without decompressing them to disk.
+//
+// [Start] must be called first; Backfill returns once everything is queued, so call [Close] to wait for the uploads.
+func (c *DiskAsyncS3Cache) Backfill(ctx context.Context, opts BackfillOptions) (BackfillResult, error) {
+	var res BackfillResult
+	var tick <-chan time.Time
+	if opts.RateLimit > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.RateLimit))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	err := c.diskCache.walkEntries(func(actionID string, ie indexEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res.Scanned++
+		if c.knownRemote(actionID) {
+			return nil
+		}
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		exists, err := c.s3Exists(ctx, actionID)
+		if err != nil {
+			c.log.Warn("backfill: checking s3", "actionID", actionID, "err", err)
+			return nil
+		}
+		if exists {
+			return nil
+		}
+		res.Missing++
+		if opts.DryRun {
+			c.log.Info("backfill: missing from s3", "actionID", actionID, "outputID", ie.OutputID, "size", ie.Size)
+			return nil
+		}
+		out, err := c.diskCache.openOutput(ie.OutputID)
+		if err != nil {
+			c.log.Warn("backfill: output missing from disk", "actionID", actionID, "outputID", ie.OutputID, "err", err)
+			return nil
+		}
+		out.Close()
+		select {
+		case c.work <- putWork{
+			actionID:   actionID,
+			outputID:   ie.OutputID,
+			size:       ie.Size,
+			readOutput: true,
+			checked:    true,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.noteQueueDepth()
+		res.Queued++
+		return nil
+	})
+	return res, err
+}
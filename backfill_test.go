@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBackfill(t *testing.T) {
+	ctx := context.Background()
+	id := func(i int) string { return fmt.Sprintf("%064x", i) }
+	f := newFakeS3()
+	dc := NewDiskCache(t.TempDir())
+	dc.Compression, dc.CompressAfter = CompressionZstd, 24*time.Hour
+	if err := dc.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	bodies := map[string][]byte{}
+	put := func(actionID, origin string, body []byte) string {
+		t.Helper()
+		outputID, size := outputOf(t, body)
+		ie := indexEntry{Version: 1, OutputID: outputID, Size: size, TimeNanos: time.Now().UnixNano(), Origin: origin}
+		if err := dc.putEntry(actionID, ie, bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		bodies[actionID] = body
+		return outputID
+	}
+	// cold
+	cold := put(id(1), originLocal, bytes.Repeat([]byte("cold "), 2000))
+	if n, err := dc.compressColdFile(cold, dc.outputFile(cold), time.Now().Add(time.Hour)); err != nil || n < 0 {
+		t.Fatalf("compressing: %d, %v", n, err)
+	}
+	// filled from s3, but deleted from it since
+	put(id(2), originRemote, []byte("remote"))
+	// already there
+	put(id(3), originLocal, []byte("present"))
+	f.objects["p/"+id(3)] = fakeObject{body: []byte("present"), lastModified: time.Now()}
+
+	c := NewDiskAsyncS3Cache(dc, f, "bucket", "p", 4, 1)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	const rate = 20
+	start := time.Now()
+	res, err := c.Backfill(ctx, BackfillOptions{RateLimit: rate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the heads are rate limited, not just the uploads
+	if elapsed, want := time.Since(start), 2*time.Second/rate; elapsed < want {
+		t.Errorf("backfill took %v, want at least %v at %d checks per second", elapsed, want, rate)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if res != (BackfillResult{Scanned: 3, Missing: 2, Queued: 2}) {
+		t.Errorf("got %+v, want 3 scanned, 2 missing and queued", res)
+	}
+	if f.heads != 3 {
+		t.Errorf("headed %d objects, want 3", f.heads)
+	}
+	for actionID, body := range bodies {
+		if o := f.objects["p/"+actionID]; !bytes.Equal(o.body, body) {
+			t.Errorf("s3 has %q for %s, want %q", o.body, actionID, body)
+		}
+	}
+	// uploading it didn't decompress it
+	if _, err := os.Stat(dc.outputFile(cold)); !os.IsNotExist(err) {
+		t.Errorf("cold output decompressed to disk: %v", err)
+	}
+	if _, err := os.Stat(dc.outputFile(cold) + CompressionZstd.Ext()); err != nil {
+		t.Errorf("cold output gone: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// remoteObject is an object listed from S3.
+type remoteObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// listActions calls fn with every action object in S3, listing the 256 two-hex-digit key prefixes of the actionIDs
+// with up to parallel ListObjectsV2 paginations at once. fn may be called concurrently.
+//
+// Only keys of the form <prefix>/<actionID> are actions: listing <prefix>/fe also finds the objects of any other cache
+// under, say, <prefix>/feature-x/, and those must be left alone.
+func (c *DiskAsyncS3Cache) listActions(ctx context.Context, parallel int, fn func(remoteObject) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(parallel, 1))
+	for i := range 256 {
+		prefix := fmt.Sprintf("%s/%02x", c.s3Prefix, i)
+		g.Go(func() error {
+			return c.listObjects(ctx, prefix, func(o remoteObject) error {
+				actionID, ok := strings.CutPrefix(o.Key, c.s3Prefix+"/")
+				if !ok || !validID(actionID) {
+					return nil
+				}
+				return fn(o)
+			})
+		})
+	}
+	return g.Wait()
+}
+
+// listObjects calls fn with every object whose key starts with prefix.
+func (c *DiskAsyncS3Cache) listObjects(ctx context.Context, prefix string, fn func(remoteObject) error) error {
+	p := s3.NewListObjectsV2Paginator(c.s3Client, &s3.ListObjectsV2Input{
+		Bucket: &c.bucketName,
+		Prefix: &prefix,
+	})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing %s: %w", prefix, err)
+		}
+		for _, o := range page.Contents {
+			if err := fn(newRemoteObject(o)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newRemoteObject(o types.Object) remoteObject {
+	r := remoteObject{}
+	if o.Key != nil {
+		r.Key = *o.Key
+	}
+	if o.Size != nil {
+		r.Size = *o.Size
+	}
+	if o.LastModified != nil {
+		r.LastModified = *o.LastModified
+	}
+	return r
+}
+
+// ageBuckets are the upper bounds of the age histogram of [BucketStats]; the last bucket is everything older.
+var ageBuckets = []struct {
+	name string
+	age  time.Duration
+}{
+	{"<1d", 24 * time.Hour},
+	{"1d-7d", 7 * 24 * time.Hour},
+	{"7d-30d", 30 * 24 * time.Hour},
+	{"30d-90d", 90 * 24 * time.Hour},
+	{"90d-1y", 365 * 24 * time.Hour},
+	{">1y", 0},
+}
+
+// AgeBucket counts the objects last modified within an age range.
+type AgeBucket struct {
+	Name  string `json:"name"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// BucketStats describes the action objects in S3. Sizes are as stored, i.e. after compression.
+type BucketStats struct {
+	Bucket  string             `json:"bucket"`
+	Prefix  string             `json:"prefix"`
+	Objects int64              `json:"objects"`
+	Bytes   int64              `json:"bytes"`
+	Sizes   distributionReport `json:"sizeBytes"`
+	Oldest  time.Time          `json:"oldest"`
+	Newest  time.Time          `json:"newest"`
+	Ages    []AgeBucket        `json:"ages"`
+	Largest []remoteObject     `json:"largest"`
+}
+
+// BucketStats lists the action objects in S3 (with up to parallel listings at once) and summarizes them, keeping the
+// top largest. It doesn't need [Start].
+func (c *DiskAsyncS3Cache) BucketStats(ctx context.Context, parallel, top int) (*BucketStats, error) {
+	start := time.Now()
+	st := &BucketStats{Bucket: c.bucketName, Prefix: c.s3Prefix, Ages: make([]AgeBucket, len(ageBuckets))}
+	for i, b := range ageBuckets {
+		st.Ages[i].Name = b.name
+	}
+	var sizes sizeHistogram
+	var mu sync.Mutex
+	err := c.listActions(ctx, parallel, func(o remoteObject) error {
+		sizes.observe(o.Size)
+		mu.Lock()
+		defer mu.Unlock()
+		st.add(o, start, top)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	st.Sizes = newDistributionReport(sizes.snapshot())
+	slices.SortFunc(st.Largest, func(a, b remoteObject) int { return cmp.Compare(b.Size, a.Size) })
+	return st, nil
+}
+
+func (st *BucketStats) add(o remoteObject, now time.Time, top int) {
+	st.Objects++
+	st.Bytes += o.Size
+	if st.Oldest.IsZero() || o.LastModified.Before(st.Oldest) {
+		st.Oldest = o.LastModified
+	}
+	if o.LastModified.After(st.Newest) {
+		st.Newest = o.LastModified
+	}
+	age := now.Sub(o.LastModified)
+	i := len(ageBuckets) - 1
+	for j, b := range ageBuckets[:i] {
+		if age < b.age {
+			i = j
+			break
+		}
+	}
+	st.Ages[i].Count++
+	st.Ages[i].Bytes += o.Size
+
+	if top <= 0 {
+		return
+	}
+	// keep the top largest, replacing the smallest of them when full
+	if len(st.Largest) < top {
+		st.Largest = append(st.Largest, o)
+		return
+	}
+	smallest := 0
+	for i, l := range st.Largest {
+		if l.Size < st.Largest[smallest].Size {
+			smallest = i
+		}
+	}
+	if o.Size > st.Largest[smallest].Size {
+		st.Largest[smallest] = o
+	}
+}
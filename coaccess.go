@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// coaccessPath is where the co-access index lives under the s3 prefix. Each run puts the groups it saw as an object
+	// of its own, so concurrent runs don't overwrite each other's.
+	coaccessPath = "_coaccess"
+	// coaccessGroupSize is how many consecutive remote hits make up a group
+	coaccessGroupSize = 32
+	// maxCoaccessGroups caps the groups a run puts, which keeps each object under about 70 KB
+	maxCoaccessGroups = 32
+	// coaccessRuns is how many of the latest runs' groups are loaded; gc deletes the older ones
+	coaccessRuns = 8
+)
+
+// coaccessIndex groups actions that were fetched from S3 together in previous runs. cmd/go gets actions in dependency
+// order, so actions that were fetched one after another last time are likely to be fetched together again.
+type coaccessIndex struct {
+	mu     sync.Mutex
+	groups [][]string
+	// group maps actionIDs to their index in groups
+	group map[string]int
+	// triggered is the set of groups we've already prefetched
+	triggered map[int]bool
+	// hits is the sequence of remote hits in this run, from which we make new groups
+	hits []string
+}
+
+// coaccessRun is the object a run puts under coaccessPath.
+type coaccessRun struct {
+	Groups [][]string `json:"groups"`
+}
+
+// coaccessKey is the key for a run's groups put at t. Keys count down, so that a listing (which is in key order) has
+// the latest first.
+func (c *DiskAsyncS3Cache) coaccessKey(t time.Time) string {
+	return fmt.Sprintf("%s/%s/%019d-%08x", c.s3Prefix, coaccessPath, math.MaxInt64-t.UnixNano(), rand.Uint32())
+}
+
+// listCoaccess lists the runs' objects under coaccessPath, latest first.
+func (c *DiskAsyncS3Cache) listCoaccess(ctx context.Context, fn func(remoteObject) error) error {
+	return c.listObjects(ctx, fmt.Sprintf("%s/%s/", c.s3Prefix, coaccessPath), fn)
+}
+
+// loadCoaccess gets the groups of the latest coaccessRuns runs from S3. An action in the groups of more than one run
+// stays in its latest.
+func (c *DiskAsyncS3Cache) loadCoaccess(ctx context.Context) ([][]string, error) {
+	prefix := fmt.Sprintf("%s/%s/", c.s3Prefix, coaccessPath)
+	list, err := c.s3Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  &c.bucketName,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int32(coaccessRuns),
+	})
+	if err != nil {
+		return nil, err
+	}
+	runs := make([]coaccessRun, len(list.Contents))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, o := range list.Contents {
+		g.Go(func() error {
+			out, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: &c.bucketName,
+				Key:    o.Key,
+			})
+			if isS3NotFoundError(err) {
+				// gc got to it first
+				return nil
+			} else if err != nil {
+				return err
+			}
+			defer out.Body.Close()
+			if err := json.NewDecoder(out.Body).Decode(&runs[i]); err != nil {
+				return fmt.Errorf("decoding %s: %w", aws.ToString(o.Key), err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var groups [][]string
+	for _, run := range runs {
+		for _, old := range run.Groups {
+			var kept []string
+			for _, actionID := range old {
+				if !seen[actionID] {
+					seen[actionID] = true
+					kept = append(kept, actionID)
+				}
+			}
+			if len(kept) > 1 {
+				groups = append(groups, kept)
+			}
+		}
+	}
+	return groups, nil
+}
+
+// load sets the groups to prefetch from.
+func (idx *coaccessIndex) load(groups [][]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.groups = groups
+	idx.group = make(map[string]int)
+	idx.triggered = make(map[int]bool)
+	for i, g := range groups {
+		for _, actionID := range g {
+			idx.group[actionID] = i
+		}
+	}
+}
+
+// hit records a remote hit, and returns the rest of its group if this is the group's first hit.
+func (idx *coaccessIndex) hit(actionID string) []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.hits = append(idx.hits, actionID)
+	i, ok := idx.group[actionID]
+	if !ok || idx.triggered[i] {
+		return nil
+	}
+	idx.triggered[i] = true
+	var rest []string
+	for _, other := range idx.groups[i] {
+		if other != actionID {
+			rest = append(rest, other)
+		}
+	}
+	return rest
+}
+
+// runGroups makes groups out of this run's hits, up to maxCoaccessGroups of them. The first are kept, since builds
+// tend to start the same way.
+func (idx *coaccessIndex) runGroups() [][]string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	seen := make(map[string]bool)
+	var groups [][]string
+	var g []string
+	for _, actionID := range idx.hits {
+		if seen[actionID] {
+			continue
+		}
+		seen[actionID] = true
+		g = append(g, actionID)
+		if len(g) == coaccessGroupSize {
+			groups = append(groups, g)
+			g = nil
+			if len(groups) == maxCoaccessGroups {
+				return groups
+			}
+		}
+	}
+	if len(g) > 1 {
+		groups = append(groups, g)
+	}
+	return groups
+}
+
+// putCoaccess puts the groups of this run's hits, if there are any.
+func (c *DiskAsyncS3Cache) putCoaccess(ctx context.Context) error {
+	groups := c.coaccess.runGroups()
+	if len(groups) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(coaccessRun{Groups: groups})
+	if err != nil {
+		return err
+	}
+	size := int64(len(body))
+	key := c.coaccessKey(time.Now())
+	c.log.Debug("put co-access groups", "key", key, "groups", len(groups))
+	_, err = c.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &c.bucketName,
+		Key:           &key,
+		Body:          bytes.NewReader(body),
+		ContentLength: &size,
+	})
+	return err
+}
+
+// coaccessHit records a remote hit (or a hit on something we prefetched) and kicks off downloads of the rest of its
+// group, if it has one.
+func (c *DiskAsyncS3Cache) coaccessHit(actionID string) {
+	rest := c.coaccess.hit(actionID)
+	if len(rest) > 0 {
+		c.log.Debug("prefetching co-access group", "actionID", actionID, "n", len(rest))
+	}
+	for _, other := range rest {
+		select {
+		case c.prefetchQueue <- other:
+		default:
+			// the workers are behind; they'd likely be too late anyway
+			return
+		}
+	}
+}
+
+// prefetchWorker fills the disk cache with actions from the prefetch queue until ctx is done.
+func (c *DiskAsyncS3Cache) prefetchWorker(ctx context.Context) {
+	for {
+		select {
+		case actionID := <-c.prefetchQueue:
+			if _, ok := c.diskCache.entry(actionID); ok {
+				continue
+			}
+			if _, _, err := c.prefetchFill(ctx, actionID); err != nil {
+				c.log.Debug("prefetch", "actionID", actionID, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress cache objects. The zero value means no compression.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+func parseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "none":
+		return CompressionNone, nil
+	case string(CompressionGzip):
+		return CompressionGzip, nil
+	case string(CompressionZstd):
+		return CompressionZstd, nil
+	}
+	return CompressionNone, fmt.Errorf("unknown compression %q (want none, gzip or zstd)", s)
+}
+
+func (c Compression) String() string {
+	if c == CompressionNone {
+		return "none"
+	}
+	return string(c)
+}
+
+// Ext is the file extension for files compressed with c.
+func (c Compression) Ext() string {
+	switch c {
+	case CompressionGzip:
+		return ".gz"
+	case CompressionZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// NewWriter returns a writer that compresses to w. The caller must Close it to flush.
+func (c Compression) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		// concurrency 1 so we don't spin up a goroutine per CPU for every object
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown compression %q", string(c))
+}
+
+// NewReader returns a reader that decompresses r. Closing it does not close r.
+func (c Compression) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	case CompressionZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", string(c))
+}
+
+// compressToTempFile compresses all of r into a new temp file in dir named by pattern (as in [os.CreateTemp]),
+// returning it rewound, and its size. S3 wants a ContentLength up front, so we can't stream, and outputs can be too
+// big to hold in memory. The caller must close and remove the file.
+func (c Compression) compressToTempFile(dir, pattern string, r io.Reader) (_ *os.File, _ int64, retErr error) {
+	f, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	w, err := c.NewWriter(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return nil, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, 0, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decompressReadCloser decompresses body, closing both the decompressor and body on Close.
+type decompressReadCloser struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (d *decompressReadCloser) Close() error {
+	err := d.ReadCloser.Close()
+	if bErr := d.body.Close(); err == nil {
+		err = bErr
+	}
+	return err
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+var compressions = []Compression{CompressionNone, CompressionGzip, CompressionZstd}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("some output "), 1000)
+	for _, c := range compressions {
+		t.Run(c.String(), func(t *testing.T) {
+			if got, err := parseCompression(c.String()); err != nil || got != c {
+				t.Errorf("parseCompression(%q) = %q, %v", c.String(), got, err)
+			}
+
+			var buf bytes.Buffer
+			w, err := c.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write(data); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if c != CompressionNone && buf.Len() >= len(data) {
+				t.Errorf("compressed %d bytes to %d", len(data), buf.Len())
+			}
+			checkDecompresses(t, c, &buf, data)
+
+			f, size, err := c.compressToTempFile(t.TempDir(), "compress-*", bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			if fi, err := f.Stat(); err != nil || fi.Size() != size {
+				t.Errorf("compressToTempFile says %d bytes, file has %v (%v)", size, fi.Size(), err)
+			}
+			// it's rewound
+			checkDecompresses(t, c, f, data)
+		})
+	}
+	if _, err := parseCompression("lz4"); err == nil {
+		t.Error("parsed an unknown compression")
+	}
+}
+
+func checkDecompresses(t *testing.T, c Compression, r io.Reader, want []byte) {
+	t.Helper()
+	rc, err := c.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("decompressed %d bytes, want the %d put in", len(got), len(want))
+	}
+}
+
+// TestS3CompressionRoundTrip puts an object with each compression and gets it back, and gets an object put before
+// there was compression, with no metadata about it.
+func TestS3CompressionRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("some output "), 1000)
+	outputID, size := outputOf(t, data)
+	check := func(t *testing.T, c *DiskAsyncS3Cache, actionID string) {
+		t.Helper()
+		obj, err := c.s3Get(ctx, actionID)
+		if err != nil || obj == nil {
+			t.Fatalf("s3Get = %v, %v", obj, err)
+		}
+		defer obj.Body.Close()
+		if obj.OutputID != outputID || obj.Size != size {
+			t.Errorf("got outputID %s, size %d; want %s, %d", obj.OutputID, obj.Size, outputID, size)
+		}
+		got, err := io.ReadAll(obj.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("got %d bytes back, want the %d put", len(got), len(data))
+		}
+	}
+
+	for i, cmp := range compressions {
+		t.Run(cmp.String(), func(t *testing.T) {
+			f := newFakeS3()
+			// for the temp file of the compressed upload
+			c := NewDiskAsyncS3Cache(NewDiskCache(t.TempDir()), f, "bucket", "p", 1, 1)
+			c.Compression = cmp
+			actionID := fmt.Sprintf("%064x", i)
+			if err := c.s3Put(ctx, actionID, outputID, size, time.Now(), bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			o := f.objects["p/"+actionID]
+			if _, ok := o.metadata[compressionMetadataKey]; ok != (cmp != CompressionNone) {
+				t.Errorf("compression metadata %v, want it with compression %s", o.metadata, cmp)
+			}
+			check(t, c, actionID)
+		})
+	}
+
+	t.Run("no metadata", func(t *testing.T) {
+		f := newFakeS3()
+		c := NewDiskAsyncS3Cache(nil, f, "bucket", "p", 1, 1)
+		actionID := fmt.Sprintf("%064x", 10)
+		f.objects["p/"+actionID] = fakeObject{body: data, metadata: map[string]string{outputIDMetadataKey: outputID}, lastModified: time.Now()}
+		check(t, c, actionID)
+	})
+}
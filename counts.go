@@ -1,10 +1,9 @@
 package main
 
 import (
-	"encoding/csv"
 	"fmt"
-	"io"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -16,13 +15,24 @@ type Counts struct {
 	gets          atomic.Int64
 	hits          atomic.Int64
 	misses        atomic.Int64
+	coalesced     atomic.Int64
 	puts          atomic.Int64
+	deduped       atomic.Int64
+	skipped       atomic.Int64
 	getErrors     atomic.Int64
 	putErrors     atomic.Int64
 	totalGetBytes atomic.Int64
 	totalGetDur   uberatomic.Duration
 	totalPutBytes atomic.Int64
 	totalPutDur   uberatomic.Duration
+	// raw byte totals are before compression; they equal the totals above when nothing is compressed
+	totalGetRawBytes atomic.Int64
+	totalPutRawBytes atomic.Int64
+	// latencies and sizes of individual operations
+	getLatency latencyHistogram
+	putLatency latencyHistogram
+	getSizes   sizeHistogram
+	putSizes   sizeHistogram
 }
 
 func (c *Counts) Summary() string {
@@ -32,13 +42,79 @@ func (c *Counts) Summary() string {
 		getsLine += fmt.Sprintf("; total %.2f MB; avg %.2f MB/s",
 			float64(c.totalGetBytes.Load())/1_000_000.0, float64(c.totalGetBytes.Load())/1_000_000.0/c.totalGetDur.Load().Seconds())
 	}
+	getsLine += rawBytesSummary(c.totalGetBytes.Load(), c.totalGetRawBytes.Load())
+	if c.coalesced.Load() > 0 {
+		getsLine += fmt.Sprintf("; %d coalesced", c.coalesced.Load())
+	}
 	putsLine := fmt.Sprintf("%d puts: %d errors, %s total dur",
 		c.puts.Load(), c.putErrors.Load(), c.totalPutDur.Load().Round(100*time.Millisecond))
 	if c.totalPutBytes.Load() > 0 {
 		putsLine += fmt.Sprintf("; total %.2f MB; avg %.2f MB/s",
 			float64(c.totalPutBytes.Load())/1_000_000.0, float64(c.totalPutBytes.Load())/1_000_000.0/c.totalPutDur.Load().Seconds())
 	}
-	return fmt.Sprintf("%s\n%s", getsLine, putsLine)
+	putsLine += rawBytesSummary(c.totalPutBytes.Load(), c.totalPutRawBytes.Load())
+	if c.deduped.Load() > 0 {
+		putsLine += fmt.Sprintf("; %d deduped", c.deduped.Load())
+	}
+	if c.skipped.Load() > 0 {
+		putsLine += fmt.Sprintf("; %d skipped", c.skipped.Load())
+	}
+	lines := []string{getsLine, putsLine}
+	if l := distributionSummary("get", c.getLatency.snapshot(), c.getSizes.snapshot()); l != "" {
+		lines = append(lines, l)
+	}
+	if l := distributionSummary("put", c.putLatency.snapshot(), c.putSizes.snapshot()); l != "" {
+		lines = append(lines, l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// distributionSummary describes the latency and size percentiles of op, if there were any
+func distributionSummary(op string, latency, sizes histogramSnapshot) string {
+	if latency.Count == 0 {
+		return ""
+	}
+	line := fmt.Sprintf("  %s latency: p50 %s, p90 %s, p99 %s, max %s", op,
+		secondsDuration(latency.Quantile(0.5)), secondsDuration(latency.Quantile(0.9)),
+		secondsDuration(latency.Quantile(0.99)), secondsDuration(latency.Max))
+	if sizes.Count > 0 {
+		line += fmt.Sprintf("; size: p50 %s, p90 %s, p99 %s, max %s",
+			formatBytes(sizes.Quantile(0.5)), formatBytes(sizes.Quantile(0.9)),
+			formatBytes(sizes.Quantile(0.99)), formatBytes(sizes.Max))
+	}
+	return line
+}
+
+// secondsDuration turns seconds into a duration rounded to about 3 significant figures
+func secondsDuration(secs float64) time.Duration {
+	d := time.Duration(secs * float64(time.Second))
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+func formatBytes(n float64) string {
+	switch {
+	case n >= 1_000_000_000:
+		return fmt.Sprintf("%.2f GB", n/1_000_000_000.0)
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.2f MB", n/1_000_000.0)
+	case n >= 1_000:
+		return fmt.Sprintf("%.2f KB", n/1_000.0)
+	}
+	return fmt.Sprintf("%.0f B", n)
+}
+
+// rawBytesSummary describes the compression ratio, if any compression happened
+func rawBytesSummary(bytes, rawBytes int64) string {
+	if rawBytes == 0 || rawBytes == bytes {
+		return ""
+	}
+	return fmt.Sprintf("; raw %.2f MB; ratio %.2f", float64(rawBytes)/1_000_000.0, float64(rawBytes)/float64(bytes))
 }
 
 // TODO: maybe there's a way to do this in stdlib, but I couldn't find it
@@ -48,15 +124,13 @@ func csvDuration(d time.Duration) string {
 	return time.Unix(0, 0).UTC().Add(d).Format("15:04:05.000")
 }
 
-func (c *Counts) CSV(f io.Writer, header bool) error {
-	w := csv.NewWriter(f)
-	if header {
-		err := w.Write([]string{"gets", "hits", "misses", "puts", "getErrors", "putErrors", "totalGetBytes", "totalGetDur", "totalPutBytes", "totalPutDur"})
-		if err != nil {
-			return err
-		}
-	}
-	err := w.Write([]string{
+// countsCSVHeader names the columns of [Counts.csvRecord]
+var countsCSVHeader = []string{"gets", "hits", "misses", "puts", "getErrors", "putErrors", "totalGetBytes", "totalGetDur", "totalPutBytes", "totalPutDur", "totalGetRawBytes", "totalPutRawBytes", "deduped", "skipped", "coalesced",
+	"getP50Secs", "getP90Secs", "getP99Secs", "getMaxSecs", "putP50Secs", "putP90Secs", "putP99Secs", "putMaxSecs",
+	"getSizeP50", "getSizeP90", "getSizeP99", "getSizeMax", "putSizeP50", "putSizeP90", "putSizeP99", "putSizeMax"}
+
+func (c *Counts) csvRecord() []string {
+	record := []string{
 		strconv.Itoa(int(c.gets.Load())),
 		strconv.Itoa(int(c.hits.Load())),
 		strconv.Itoa(int(c.misses.Load())),
@@ -67,10 +141,25 @@ func (c *Counts) CSV(f io.Writer, header bool) error {
 		csvDuration(c.totalGetDur.Load()),
 		strconv.Itoa(int(c.totalPutBytes.Load())),
 		csvDuration(c.totalPutDur.Load()),
-	})
-	if err != nil {
-		return err
+		strconv.Itoa(int(c.totalGetRawBytes.Load())),
+		strconv.Itoa(int(c.totalPutRawBytes.Load())),
+		strconv.Itoa(int(c.deduped.Load())),
+		strconv.Itoa(int(c.skipped.Load())),
+		strconv.Itoa(int(c.coalesced.Load())),
+	}
+	record = append(record, csvQuantiles(c.getLatency.snapshot(), 'f', 6)...)
+	record = append(record, csvQuantiles(c.putLatency.snapshot(), 'f', 6)...)
+	record = append(record, csvQuantiles(c.getSizes.snapshot(), 'f', 0)...)
+	record = append(record, csvQuantiles(c.putSizes.snapshot(), 'f', 0)...)
+	return record
+}
+
+// csvQuantiles formats the p50, p90, p99 and max of s
+func csvQuantiles(s histogramSnapshot, format byte, prec int) []string {
+	return []string{
+		strconv.FormatFloat(s.Quantile(0.5), format, prec, 64),
+		strconv.FormatFloat(s.Quantile(0.9), format, prec, 64),
+		strconv.FormatFloat(s.Quantile(0.99), format, prec, 64),
+		strconv.FormatFloat(s.Max, format, prec, 64),
 	}
-	w.Flush()
-	return w.Error()
 }
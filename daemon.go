@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/cacheproc"
+)
+
+// Each go command starts its own GOCACHEPROG, which means loading the AWS config, probing S3 and starting with an empty
+// upload queue every time, and losing whatever's left in the queue when it exits. The daemon (the serve subcommand)
+// owns the disk and S3 tiers for as long as it runs, and GOCACHEPROGs with -daemon-socket just relay the cacheproc
+// protocol to it, so concurrent and consecutive go commands share one warm process.
+
+// relayToDaemon relays stdin and stdout to the daemon listening on socket. It returns false if there's no daemon, in
+// which case the caller should serve cmd/go itself.
+func relayToDaemon(socket string) (bool, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		slog.Warn("no daemon; running in-process", "socket", socket, "err", err)
+		return false, nil
+	}
+	defer conn.Close()
+	slog.Debug("relaying to daemon", "socket", socket)
+	go func() {
+		if _, err := io.Copy(conn, os.Stdin); err != nil {
+			slog.Debug("relaying stdin to daemon", "err", err)
+		}
+		// tell the daemon we're done, so it finishes up and closes its end
+		conn.(*net.UnixConn).CloseWrite()
+	}()
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		return true, fmt.Errorf("relaying daemon to stdout: %w", err)
+	}
+	return true, nil
+}
+
+// runServe implements the serve subcommand: it serves the cacheproc protocol to each connection on the socket until
+// it gets SIGINT or SIGTERM, then waits for connected clients and the upload queue before exiting.
+func runServe(ctx context.Context, cacher *DiskAsyncS3Cache, args []string, procs *processStats) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	socket := fs.String("socket", *flagDaemonSocket, "unix socket to listen on")
+	fs.Parse(args)
+	if *socket == "" {
+		return errors.New("serve: no socket; set -daemon-socket or -socket")
+	}
+	if conn, err := net.Dial("unix", *socket); err == nil {
+		conn.Close()
+		return fmt.Errorf("serve: a daemon is already listening on %s", *socket)
+	}
+	// nobody's listening, so it's a leftover from a daemon that didn't exit cleanly
+	_ = os.Remove(*socket)
+
+	// the socket gives full access to the cache, so keep it to ourselves. Listen before starting the cache, since
+	// listenPrivate changes the umask of the whole process for a moment.
+	ln, err := listenPrivate(*socket)
+	if err != nil {
+		return err
+	}
+	// not sigCtx: we want the workers to drain the queue after a signal, not stop
+	if err := cacher.Start(ctx); err != nil {
+		ln.Close()
+		return fmt.Errorf("failed to start cache: %w", err)
+	}
+	slog.Info("daemon listening", "socket", *socket)
+
+	sigCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-sigCtx.Done()
+		// a second signal kills us the usual way
+		stop()
+		slog.Info("daemon shutting down; waiting for clients")
+		ln.Close()
+	}()
+
+	// the limits are on the daemon as a whole, however many clients it has
+	limits := cacheproc.NewLimits(*flagMaxGets, *flagMaxPuts)
+	var clients sync.WaitGroup
+	var acceptErr error
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if sigCtx.Err() == nil {
+				acceptErr = err
+			}
+			break
+		}
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			defer conn.Close()
+			slog.Debug("daemon client connected")
+			proc := newProcess(cacher)
+			proc.Limits = limits
+			// the cache outlives its clients
+			proc.Close = func() error { return nil }
+			procs.start(proc)
+			defer procs.done(proc)
+			if err := proc.Serve(conn, conn); err != nil {
+				slog.Warn("daemon client", "err", err)
+			}
+			slog.Debug("daemon client done")
+		}()
+	}
+	clients.Wait()
+	return errors.Join(acceptErr, cacher.Close())
+}
@@ -11,7 +11,11 @@ import (
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // indexEntry is the metadata that SimpleDiskCache stores on disk for an ActionID.
@@ -20,8 +24,19 @@ type indexEntry struct {
 	OutputID  string `json:"o"`
 	Size      int64  `json:"n"`
 	TimeNanos int64  `json:"t"`
+	// Origin is where the entry came from: originLocal or originRemote. Older entries have none, which means local.
+	Origin string `json:"src,omitempty"`
+	// ETag is the ETag of the remote object the entry was filled from, if Origin is originRemote.
+	ETag string `json:"e,omitempty"`
 }
 
+const (
+	// originLocal entries were Put by cmd/go, i.e. built locally.
+	originLocal = "local"
+	// originRemote entries were filled from the remote store.
+	originRemote = "remote"
+)
+
 // DiskCache is a cache that stores objects as files on disk.
 //
 // It is a fork of [github.com/bradfitz/go-tool-cache/blob/main/cachers/disk.go#DiskCache] that adds counters and more logging
@@ -30,33 +45,67 @@ type DiskCache struct {
 	dir     string
 	started bool
 	log     *slog.Logger
+
+	// Compression, if set, compresses output files that haven't been used for CompressAfter, in the background after
+	// the cache starts. Compressed ("cold") outputs are decompressed back into place on demand by Get, since cmd/go
+	// needs a plain file.
+	Compression   Compression
+	CompressAfter time.Duration
+
+	// stopMaintenance stops the background pass started by Start, and maintenanceDone is closed when it has
+	stopMaintenance context.CancelFunc
+	maintenanceDone chan struct{}
 }
 
+// maintenanceBudget is how long the background pass of a run may take. A big cache that's new to compression takes
+// a few runs to get through, since each pass skips what earlier ones compressed.
+const maintenanceBudget = 2 * time.Minute
+
 func NewDiskCache(dir string) *DiskCache {
 	return &DiskCache{
 		dir: dir,
-		log: slog.Default().WithGroup("disk"),
+		log: slog.Default().With(componentKey, "disk"),
 	}
 }
 
 func (c *DiskCache) Start(context.Context) error {
 	c.log.Debug("start", "dir", c.dir)
-	err := os.MkdirAll(c.dir, 0755)
+	err := os.MkdirAll(c.locksDir(), 0755)
 	if err != nil {
 		return err
 	}
+	if c.Compression != CompressionNone {
+		// its existence tells the other processes sharing the dir to note their uses too (see noteUsed)
+		if err := os.MkdirAll(c.usedDir(), 0755); err != nil {
+			return err
+		}
+	}
+	if c.started {
+		// e.g. by a DiskAsyncS3Cache wrapping it; the pass is already running
+		return nil
+	}
 	c.started = true
+	ctx, cancel := context.WithTimeout(context.Background(), maintenanceBudget)
+	done := make(chan struct{})
+	c.stopMaintenance, c.maintenanceDone = cancel, done
+	go func() {
+		defer close(done)
+		c.maintain(ctx)
+	}()
 	return nil
 }
 
-func (c *DiskCache) Get(_ context.Context, actionID string) (outputID, diskPath string, err error) {
+func (c *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
 	if !c.started {
 		log.Fatal("not started")
 	}
+	_, span := tracer.Start(ctx, "disk.Get")
+	defer func() { endSpan(span, err) }()
+	start := time.Now()
+	defer func() { c.getLatency.observe(time.Since(start)) }()
 	c.Counts.gets.Add(1)
-	c.log.Debug("get", "actionID", actionID)
-	actionFile := filepath.Join(c.dir, fmt.Sprintf("a-%s", actionID))
-	ij, err := os.ReadFile(actionFile)
+	c.log.DebugContext(ctx, "get", "actionID", actionID)
+	ij, err := os.ReadFile(c.actionFile(actionID))
 	if err != nil {
 		if os.IsNotExist(err) {
 			c.Counts.misses.Add(1)
@@ -67,7 +116,7 @@ func (c *DiskCache) Get(_ context.Context, actionID string) (outputID, diskPath
 	}
 	var ie indexEntry
 	if err := json.Unmarshal(ij, &ie); err != nil {
-		c.log.Error("json error", "actionID", actionID, "err", err)
+		c.log.ErrorContext(ctx, "json error", "actionID", actionID, "err", err)
 		c.Counts.getErrors.Add(1)
 		return "", "", nil
 	}
@@ -76,54 +125,305 @@ func (c *DiskCache) Get(_ context.Context, actionID string) (outputID, diskPath
 		// Protect against malicious non-hex OutputID on disk
 		return "", "", nil
 	}
+	outputFile, err := c.hotOutputFile(ie.OutputID)
+	if err != nil {
+		c.Counts.getErrors.Add(1)
+		return "", "", err
+	}
+	if outputFile == "" {
+		c.Counts.misses.Add(1)
+		return "", "", nil
+	}
 	c.Counts.hits.Add(1)
-	return ie.OutputID, filepath.Join(c.dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
+	c.getSizes.observe(ie.Size)
+	return ie.OutputID, outputFile, nil
 }
 
-func (c *DiskCache) Put(_ context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+func (c *DiskCache) outputFile(outputID string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("o-%s", outputID))
+}
+
+// hotOutputFile returns the path of the uncompressed output file, decompressing a cold one if need be, and notes
+// that it was used. It returns "" if there is no output file at all. It holds the output's lock while it looks, so
+// that no process sharing the dir compresses the file between our look and the use we note, which keeps it hot for
+// CompressAfter.
+//
+// It leaves the file's mtime alone: cmd/go takes it as the time of the entry (e.g. to expire test results after
+// go clean -testcache), so it must stay the time of the put.
+func (c *DiskCache) hotOutputFile(outputID string) (string, error) {
+	file := c.outputFile(outputID)
+	unlock, err := c.lock("o-" + outputID)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if _, err := os.Stat(file); err == nil {
+		c.noteUsed(outputID)
+		return file, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	for _, compression := range []Compression{CompressionZstd, CompressionGzip} {
+		coldFile := file + compression.Ext()
+		f, err := os.Open(coldFile)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		c.log.Debug("decompress", "outputID", outputID, "compression", compression)
+		r, err := compression.NewReader(f)
+		if err != nil {
+			return "", fmt.Errorf("decompressing %s: %w", coldFile, err)
+		}
+		defer r.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		if _, err := writeAtomic(file, r); err != nil {
+			return "", fmt.Errorf("decompressing %s: %w", coldFile, err)
+		}
+		// the cold file kept the time of the put
+		if err := os.Chtimes(file, fi.ModTime(), fi.ModTime()); err != nil {
+			return "", err
+		}
+		_ = os.Remove(coldFile)
+		c.noteUsed(outputID)
+		return file, nil
+	}
+	return "", nil
+}
+
+// entry reads the index entry for actionID without touching the counts. It returns false if there isn't a valid one.
+func (c *DiskCache) entry(actionID string) (indexEntry, bool) {
+	var ie indexEntry
+	ij, err := os.ReadFile(c.actionFile(actionID))
+	if err != nil {
+		return ie, false
+	}
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return ie, false
+	}
+	return ie, true
+}
+
+// reportedFile is an empty file whose mtime is when a hit on the action was last reported to the remote store in an
+// access marker. It's kept apart from the index entry so that recording a report never races with a put rewriting it.
+func (c *DiskCache) reportedFile(actionID string) string {
+	return filepath.Join(c.dir, "reported", actionID)
+}
+
+// setAccessReported records that a hit on actionID was reported at t.
+func (c *DiskCache) setAccessReported(actionID string, t time.Time) error {
+	file := c.reportedFile(actionID)
+	err := os.Chtimes(file, t, t)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err = os.WriteFile(file, nil, 0644); err != nil {
+			return err
+		}
+		err = os.Chtimes(file, t, t)
+	}
+	return err
+}
+
+// accessReported is when a hit on actionID was last reported, or the zero time if never.
+func (c *DiskCache) accessReported(actionID string) time.Time {
+	fi, err := os.Stat(c.reportedFile(actionID))
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// walkEntries calls fn for each valid index entry on disk, stopping at the first error.
+func (c *DiskCache) walkEntries(fn func(actionID string, ie indexEntry) error) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		actionID, ok := strings.CutPrefix(e.Name(), "a-")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		// skips temp files
+		if _, err := hex.DecodeString(actionID); err != nil {
+			continue
+		}
+		ie, ok := c.entry(actionID)
+		if !ok {
+			continue
+		}
+		if err := fn(actionID, ie); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *DiskCache) actionFile(actionID string) string {
+	return filepath.Join(c.dir, fmt.Sprintf("a-%s", actionID))
+}
+
+func (c *DiskCache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, _ error) {
+	return c.putWithOrigin(ctx, actionID, outputID, size, body, originLocal, "")
+}
+
+// putWithOrigin is Put, recording where the entry came from in the index.
+func (c *DiskCache) putWithOrigin(ctx context.Context, actionID, outputID string, size int64, body io.Reader, origin, etag string) (diskPath string, retErr error) {
 	if !c.started {
 		log.Fatal("not started")
 	}
+	_, span := tracer.Start(ctx, "disk.Put", trace.WithAttributes(attribute.String("gocacheprog.origin", origin)))
+	defer func() { endSpan(span, retErr) }()
+	start := time.Now()
 	c.Counts.puts.Add(1)
-	c.log.Debug("put", "actionID", actionID, "outputID", outputID, "size", size)
-	file := filepath.Join(c.dir, fmt.Sprintf("o-%s", outputID))
+	c.log.DebugContext(ctx, "put", "actionID", actionID, "outputID", outputID, "size", size, "origin", origin)
+	err := c.putEntry(actionID, indexEntry{
+		Version:   1,
+		OutputID:  outputID,
+		Size:      size,
+		TimeNanos: time.Now().UnixNano(),
+		Origin:    origin,
+		ETag:      etag,
+	}, body)
+	if err != nil {
+		c.Counts.putErrors.Add(1)
+		return "", err
+	}
+	c.putLatency.observe(time.Since(start))
+	c.putSizes.observe(size)
+	return c.outputFile(outputID), nil
+}
+
+// putEntry writes the output and then the index entry ie for actionID, without touching the counts.
+func (c *DiskCache) putEntry(actionID string, ie indexEntry, body io.Reader) error {
+	if err := c.putOutput(ie.OutputID, ie.Size, body); err != nil {
+		return err
+	}
+	ij, err := json.Marshal(ie)
+	if err != nil {
+		return err
+	}
+	_, err = writeAtomic(c.actionFile(actionID), bytes.NewReader(ij))
+	return err
+}
+
+// putOutput writes the output file, unless we already have it.
+func (c *DiskCache) putOutput(outputID string, size int64, body io.Reader) error {
+	file := c.outputFile(outputID)
+	// another process could be compressing or decompressing the same output
+	unlock, err := c.lock("o-" + outputID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	// Special case empty files; they're both common and easier to do race-free.
 	if size == 0 {
 		zf, err := os.OpenFile(file, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
 		if err != nil {
-			c.Counts.putErrors.Add(1)
-			return "", err
+			return err
 		}
 		_ = zf.Close()
+	} else if c.hasOutput(file, size) {
+		// outputs are content-addressed, so we already have this one; no need to write it again
+		c.Counts.deduped.Add(1)
+		c.log.Debug("put deduped", "outputID", outputID)
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		// but it must look as if we had, since cmd/go takes the mtime as the time of the put
+		now := time.Now()
+		if err := os.Chtimes(file, now, now); err != nil {
+			return err
+		}
 	} else {
 		wrote, err := writeAtomic(file, body)
 		if err != nil {
-			c.Counts.putErrors.Add(1)
-			return "", err
+			return err
 		}
 		if wrote != size {
-			c.Counts.putErrors.Add(1)
-			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+			return fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+		}
+		// the output is hot again, so drop any cold copy
+		for _, compression := range []Compression{CompressionZstd, CompressionGzip} {
+			_ = os.Remove(file + compression.Ext())
 		}
 	}
+	return nil
+}
 
-	ij, err := json.Marshal(indexEntry{
-		Version:   1,
-		OutputID:  outputID,
-		Size:      size,
-		TimeNanos: time.Now().UnixNano(),
-	})
+func (c *DiskCache) locksDir() string {
+	return filepath.Join(c.dir, "locks")
+}
+
+// lock takes a lock on name that is exclusive across processes sharing the cache dir, so that only one of them fills
+// an action ("a-<actionID>") or rewrites an output file ("o-<outputID>") at a time. To avoid deadlocks, never take an
+// action lock while holding an output lock.
+func (c *DiskCache) lock(name string) (unlock func(), _ error) {
+	return lockFile(filepath.Join(c.locksDir(), name+".lock"))
+}
+
+// lookup is Get without the counts, for callers that just want to know if the action is here.
+func (c *DiskCache) lookup(actionID string) (outputID, diskPath string) {
+	ie, ok := c.entry(actionID)
+	if !ok {
+		return "", ""
+	}
+	diskPath, err := c.hotOutputFile(ie.OutputID)
+	if err != nil || diskPath == "" {
+		return "", ""
+	}
+	return ie.OutputID, diskPath
+}
+
+// hasOutput reports whether the uncompressed output file exists with the given size.
+func (c *DiskCache) hasOutput(file string, size int64) bool {
+	fi, err := os.Stat(file)
+	return err == nil && fi.Mode().IsRegular() && fi.Size() == size
+}
+
+func (c *DiskCache) usedDir() string {
+	return filepath.Join(c.dir, "used")
+}
+
+// usedFile is an empty file whose mtime is when the output was last used, which is how we tell hot outputs from cold
+// ones.
+func (c *DiskCache) usedFile(outputID string) string {
+	return filepath.Join(c.usedDir(), outputID)
+}
+
+// noteUsed records that the output was just used, if anyone compresses the cache's cold outputs: we do, or the used
+// dir exists because a process sharing the dir does.
+func (c *DiskCache) noteUsed(outputID string) {
+	file := c.usedFile(outputID)
+	now := time.Now()
+	err := os.Chtimes(file, now, now)
+	if os.IsNotExist(err) {
+		err = os.WriteFile(file, nil, 0644)
+		if os.IsNotExist(err) && c.Compression == CompressionNone {
+			// nobody compresses this cache
+			return
+		}
+	}
 	if err != nil {
-		c.Counts.putErrors.Add(1)
-		return "", err
+		c.log.Warn("noting output used", "outputID", outputID, "err", err)
 	}
-	actionFile := filepath.Join(c.dir, fmt.Sprintf("a-%s", actionID))
-	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
-		c.Counts.putErrors.Add(1)
-		return "", err
+}
+
+// lastUsed is when the output file fi was last used: put, or gotten since.
+func (c *DiskCache) lastUsed(outputID string, fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	if ui, err := os.Stat(c.usedFile(outputID)); err == nil && ui.ModTime().After(t) {
+		t = ui.ModTime()
 	}
-	return file, nil
+	return t
 }
 
 func (c *DiskCache) Close() error {
@@ -132,9 +432,211 @@ func (c *DiskCache) Close() error {
 	}
 	c.started = false
 	c.log.Debug("close")
+	// the pass stops after the file it's on; the next run picks up the rest
+	c.stopMaintenance()
+	<-c.maintenanceDone
 	return nil
 }
 
+// maintain compresses cold outputs, if the cache compresses them, and removes the sidecar files (used, reported and
+// lock files) of outputs and actions that are gone, until ctx is done.
+func (c *DiskCache) maintain(ctx context.Context) {
+	if c.Compression != CompressionNone {
+		if err := c.compressCold(ctx); err != nil {
+			c.log.Warn("compressing cold outputs", "err", err)
+		}
+	}
+	if err := c.pruneSidecars(ctx); err != nil {
+		c.log.Warn("pruning sidecar files", "err", err)
+	}
+}
+
+const minColdCompressSize = 4096
+
+// compressCold compresses the output files that haven't been used for CompressAfter, until ctx is done. Outputs in
+// use are safe, since hotOutputFile notes their use under the same lock we check it under.
+func (c *DiskCache) compressCold(ctx context.Context) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-c.CompressAfter)
+	var n int
+	var saved int64
+	defer func() { c.log.Info("compressed cold outputs", "n", n, "savedBytes", saved) }()
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		name := e.Name()
+		outputID, ok := strings.CutPrefix(name, "o-")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		// skips temp files and already compressed files
+		if _, err := hex.DecodeString(outputID); err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		// small files aren't worth it; they may not even get smaller
+		if err != nil || fi.Size() < minColdCompressSize || c.lastUsed(outputID, fi).After(cutoff) {
+			continue
+		}
+		file := filepath.Join(c.dir, name)
+		compressedSize, err := c.compressColdFile(outputID, file, cutoff)
+		if err != nil {
+			c.log.Warn("compressing cold output", "file", file, "err", err)
+			continue
+		}
+		if compressedSize < 0 {
+			// it got hot while we weren't looking
+			continue
+		}
+		n++
+		saved += fi.Size() - compressedSize
+	}
+	return nil
+}
+
+// staleLockAge is how old a lock file must be to be pruned. Locks are only held for a file's worth of work, and
+// unlocking removes them, so old ones were left by processes that died holding them.
+const staleLockAge = time.Hour
+
+// pruneSidecars removes the used files of outputs that are gone, the reported files of actions that are gone, and lock
+// files left behind, until ctx is done.
+func (c *DiskCache) pruneSidecars(ctx context.Context) error {
+	var pruned int
+	defer func() {
+		if pruned > 0 {
+			c.log.Info("pruned sidecar files", "n", pruned)
+		}
+	}()
+	err := c.pruneDir(ctx, c.usedDir(), &pruned, func(file string, _ os.FileInfo) bool {
+		outputID := filepath.Base(file)
+		// under the lock, so we don't remove the used file of an output being put or decompressed
+		unlock, err := c.lock("o-" + outputID)
+		if err != nil {
+			return false
+		}
+		defer unlock()
+		for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionGzip} {
+			if _, err := os.Stat(c.outputFile(outputID) + compression.Ext()); !os.IsNotExist(err) {
+				return false
+			}
+		}
+		return os.Remove(file) == nil
+	})
+	if err != nil {
+		return err
+	}
+	err = c.pruneDir(ctx, filepath.Join(c.dir, "reported"), &pruned, func(file string, _ os.FileInfo) bool {
+		// if the action comes back, the worst that happens is that a hit on it is reported again
+		if _, err := os.Stat(c.actionFile(filepath.Base(file))); !os.IsNotExist(err) {
+			return false
+		}
+		return os.Remove(file) == nil
+	})
+	if err != nil {
+		return err
+	}
+	return c.pruneDir(ctx, c.locksDir(), &pruned, func(file string, fi os.FileInfo) bool {
+		if time.Since(fi.ModTime()) < staleLockAge {
+			return false
+		}
+		// taking the lock makes sure nobody holds it, and unlocking removes the file
+		unlock, err := lockFile(file)
+		if err != nil {
+			return false
+		}
+		unlock()
+		return true
+	})
+}
+
+// pruneDir calls prune for each file in dir until ctx is done, counting the ones it removes in pruned. A missing dir
+// is empty.
+func (c *DiskCache) pruneDir(ctx context.Context, dir string, pruned *int, prune func(file string, fi os.FileInfo) bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		if prune(filepath.Join(dir, e.Name()), fi) {
+			*pruned++
+		}
+	}
+	return nil
+}
+
+// compressColdFile compresses file if it's still cold once we have its lock; if it isn't, it returns -1.
+func (c *DiskCache) compressColdFile(outputID, file string, cutoff time.Time) (int64, error) {
+	unlock, err := c.lock("o-" + outputID)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return -1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if c.lastUsed(outputID, fi).After(cutoff) {
+		return -1, nil
+	}
+	size, err := c.compressFile(file)
+	if err == nil {
+		// it's cold now; decompressing it notes a use again
+		_ = os.Remove(c.usedFile(outputID))
+	}
+	return size, err
+}
+
+func (c *DiskCache) compressFile(file string) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	go func() {
+		w, err := c.Compression.NewWriter(pw)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if _, err := io.Copy(w, f); err != nil {
+			w.Close()
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(w.Close())
+	}()
+	size, err := writeAtomic(file+c.Compression.Ext(), pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		return 0, err
+	}
+	// keep the time of the put, for when it's decompressed
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Chtimes(file+c.Compression.Ext(), fi.ModTime(), fi.ModTime()); err != nil {
+		return 0, err
+	}
+	return size, os.Remove(file)
+}
+
 func writeTempFile(dest string, r io.Reader) (string, int64, error) {
 	tf, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*")
 	if err != nil {
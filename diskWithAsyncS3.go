@@ -9,12 +9,18 @@ import (
 	"log"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/smithy-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 type putWork struct {
@@ -22,6 +28,16 @@ type putWork struct {
 	outputID string
 	size     int64
 	diskPath string
+	// readOutput makes the upload read the output from the disk cache, hot or cold, instead of diskPath, so backfills
+	// don't decompress cold outputs to disk
+	readOutput bool
+	// putTime is when the action was put, which is kept in the object's metadata. Backfills leave it zero: an old
+	// entry uploaded now should live as long as a new one, or gc would expire it and the next backfill upload it again.
+	putTime time.Time
+	// checked is set if we already know the action isn't in S3
+	checked bool
+	// spanCtx is the span of the request that queued the work, if any
+	spanCtx trace.SpanContext
 }
 
 // DiskAsyncS3Cache is a cache that caches to disk (by wrapping DiskCache) and to S3. Puts to S3 are done asynchronously using a queue and worker pool.
@@ -36,16 +52,76 @@ type DiskAsyncS3Cache struct {
 	work       chan putWork
 	wg         *sync.WaitGroup
 	nWorkers   int
+	// maxQueueDepth is the most uploads ever queued at once, and queueWaitNanos the total time Puts spent waiting for
+	// room in a full queue
+	maxQueueDepth  atomic.Int64
+	queueWaitNanos atomic.Int64
+	// bgCtx is canceled on Close to stop background work (e.g. backfill), which is tracked by bgWG
+	bgCtx    context.Context
+	bgCancel context.CancelFunc
+	bgWG     sync.WaitGroup
+	// coaccess is the co-access index, if Coaccess is set; prefetchQueue feeds its prefetch workers
+	coaccess      *coaccessIndex
+	prefetchQueue chan string
+	// prefetched is the set of actionIDs filled before anyone asked for them
+	prefetched sync.Map
+	// requested is the set of actionIDs gotten, for the manifest
+	requested sync.Map
+	// fills coalesces concurrent fills of the same action
+	fills singleflight.Group
+	// remote is the set of actionIDs known to exist in S3 (i.e. that we've gotten, put or seen with a head)
+	remote sync.Map
+	// accessed is the set of actionIDs hit, for the access marker
+	accessed sync.Map
+
+	// Compression, if set, compresses objects of at least CompressionMinSize bytes before putting them to S3.
+	// The algorithm is recorded in the object metadata, so Gets decompress regardless of this setting.
+	Compression        Compression
+	CompressionMinSize int64
+
+	// SkipExisting makes uploads check whether the action is already in S3 (with a HeadObject) before putting it.
+	// Without it, only actions known to be there (from gets, puts and heads) are skipped, which costs nothing.
+	SkipExisting bool
+
+	// BackgroundBackfill makes Start kick off a [DiskAsyncS3Cache.Backfill] in the background, checking at most BackfillRate entries in S3 per second.
+	BackgroundBackfill bool
+	BackfillRate       float64
+
+	// Manifest, if set, names a manifest of the actionIDs gotten during this run, which is put to S3 on Close.
+	// The next run can [DiskAsyncS3Cache.Warm] the disk cache with it; Prefetch makes Start do that in the background
+	// with PrefetchWorkers workers.
+	Manifest        string
+	Prefetch        bool
+	PrefetchWorkers int
+
+	// Coaccess makes the cache learn which actions are fetched from S3 together, and prefetch the rest of a group (with
+	// PrefetchWorkers workers) on its first remote hit. What it learns is put to S3 on Close for the next run.
+	Coaccess bool
+
+	// RecordAccess makes Close put an access marker listing the actions hit (on disk or in S3) during the run, so that
+	// gc knows they're still in use. Actions whose hits were reported less than AccessInterval ago are left out, to
+	// keep the markers small.
+	RecordAccess   bool
+	AccessInterval time.Duration
 }
 
 const (
-	outputIDMetadataKey = "outputid"
-	probePath           = "_probe"
+	outputIDMetadataKey    = "outputid"
+	compressionMetadataKey = "compression"
+	rawSizeMetadataKey     = "rawsize"
+	// timeMetadataKey is when the action was put, in Unix nanoseconds. It's older than LastModified when an upload
+	// was queued for a while, or imported long after the put.
+	timeMetadataKey = "time"
+	probePath       = "_probe"
 )
 
 type s3Client interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
 }
 
 // Objects will be Put to/Getted from to s3://<bucketName>/<s3Prefix>/...
@@ -55,7 +131,7 @@ func NewDiskAsyncS3Cache(diskCache *DiskCache, client s3Client, bucketName strin
 		log.Fatalln("nWorkers must be at least 1")
 	}
 	return &DiskAsyncS3Cache{
-		log:        slog.Default().WithGroup("DiskAsyncS3"),
+		log:        slog.Default().With(componentKey, "DiskAsyncS3"),
 		work:       make(chan putWork, queueLen),
 		wg:         &sync.WaitGroup{},
 		nWorkers:   nWorkers,
@@ -76,19 +152,24 @@ func (c *DiskAsyncS3Cache) Start(ctx context.Context) error {
 
 	c.log.Debug("probing s3 cache")
 	probeStr := c.s3Prefix + "/" + probePath
-	err = c.s3Put(ctx, probeStr, probeStr, int64(len([]byte(probeStr))), bytes.NewReader([]byte(probeStr)))
+	err = c.s3Put(ctx, probeStr, probeStr, int64(len([]byte(probeStr))), time.Now(), bytes.NewReader([]byte(probeStr)))
 	if err != nil {
 		c.diskCache.Close()
 		return fmt.Errorf("s3 cache probe put failed: %w", err)
 	}
-	_, sz, _, err := c.s3Get(ctx, probeStr)
+	obj, err := c.s3Get(ctx, probeStr)
 	if err != nil {
 		c.diskCache.Close()
 		return fmt.Errorf("s3 cache probe get failed: %w", err)
 	}
-	if sz != int64(len([]byte(probeStr))) {
+	if obj == nil {
+		c.diskCache.Close()
+		return fmt.Errorf("s3 cache probe get failed: not found")
+	}
+	obj.Body.Close()
+	if obj.Size != int64(len([]byte(probeStr))) {
 		c.diskCache.Close()
-		return fmt.Errorf("s3 cache probe get size mismatch: expected %d, got %d", len([]byte(probeStr)), sz)
+		return fmt.Errorf("s3 cache probe get size mismatch: expected %d, got %d", len([]byte(probeStr)), obj.Size)
 	}
 	c.log.Debug("probe success")
 
@@ -103,27 +184,8 @@ func (c *DiskAsyncS3Cache) Start(ctx context.Context) error {
 						c.log.Debug("s3 worker done by closed work channel")
 						return
 					}
-					c.log.Debug("s3 put", "actionID", w.actionID, "outputID", w.outputID, "size", w.size, "diskPath", w.diskPath)
-					var r io.Reader
-					if w.size == 0 {
-						r = bytes.NewReader(nil)
-					} else {
-						f, err := os.Open(w.diskPath)
-						// TODO: currently we just log errors, but maybe we want a mode that fails
-						if err != nil {
-							// TODO: not sure if this shouuld be counted in Counts; those are for s3
-							c.log.Error("opening file for s3 put", "path", w.diskPath, "err", err)
-							continue
-						}
-						defer f.Close()
-						r = f
-					}
 					// TODO: not 100% on the lifetime of this context; is it until everything is started? or until Close? we may want a separate Context for workers so that they can be stopped before all work is done (i.e., on Close)
-					err := c.s3Put(ctx, w.actionID, w.outputID, w.size, r)
-					if err != nil {
-						c.log.Debug("putting to s3", "actionID", w.actionID, "outputID", w.outputID, "err", err)
-						continue
-					}
+					c.upload(ctx, w)
 				case <-ctx.Done():
 					c.log.Debug("s3 worker done by ctx.Done")
 					return
@@ -132,66 +194,300 @@ func (c *DiskAsyncS3Cache) Start(ctx context.Context) error {
 		}()
 	}
 
+	c.bgCtx, c.bgCancel = context.WithCancel(ctx)
+	if c.BackgroundBackfill {
+		c.bgWG.Add(1)
+		go func() {
+			defer c.bgWG.Done()
+			res, err := c.Backfill(c.bgCtx, BackfillOptions{RateLimit: c.BackfillRate})
+			if err != nil && !errors.Is(err, context.Canceled) {
+				c.log.Warn("background backfill", "err", err)
+			}
+			c.log.Info("background backfill done", "scanned", res.Scanned, "missing", res.Missing, "queued", res.Queued)
+		}()
+	}
+
+	if c.Coaccess {
+		c.coaccess = &coaccessIndex{}
+		// in the background, so the first gets don't wait for it; until it's loaded, hits just don't prefetch
+		c.bgWG.Add(1)
+		go func() {
+			defer c.bgWG.Done()
+			groups, err := c.loadCoaccess(c.bgCtx)
+			if err != nil {
+				if !errors.Is(err, context.Canceled) {
+					c.log.Warn("loading co-access index; starting from scratch", "err", err)
+				}
+				return
+			}
+			c.coaccess.load(groups)
+			c.log.Debug("loaded co-access index", "groups", len(groups))
+		}()
+		c.prefetchQueue = make(chan string, 1024)
+		for range max(c.PrefetchWorkers, 1) {
+			c.bgWG.Add(1)
+			go func() {
+				defer c.bgWG.Done()
+				c.prefetchWorker(c.bgCtx)
+			}()
+		}
+	}
+	if c.Prefetch && c.Manifest != "" {
+		c.bgWG.Add(1)
+		go func() {
+			defer c.bgWG.Done()
+			res, err := c.WarmFromManifest(c.bgCtx, c.Manifest, c.PrefetchWorkers)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				c.log.Warn("prefetch", "err", err)
+			}
+			c.log.Info("prefetch done", "manifest", c.Manifest, "requested", res.Requested, "local", res.Local, "fetched", res.Fetched, "missing", res.Missing, "errors", res.Errors)
+		}()
+	}
+
 	c.started = true
 
 	return nil
 }
 
-func (c *DiskAsyncS3Cache) s3Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+// upload puts the work's disk file to S3, unless the action is already there.
+// TODO: currently we just log errors, but maybe we want a mode that fails
+func (c *DiskAsyncS3Cache) upload(ctx context.Context, w putWork) {
+	// the span is a child of the request that queued the upload, even though that's long done
+	ctx, span := tracer.Start(trace.ContextWithSpanContext(ctx, w.spanCtx), "s3.upload", trace.WithAttributes(
+		attribute.String("gocacheprog.action_id", w.actionID),
+		attribute.Int64("gocacheprog.size", w.size),
+	))
+	defer span.End()
+	c.log.Debug("s3 upload", "actionID", w.actionID, "outputID", w.outputID, "size", w.size, "diskPath", w.diskPath)
+	if !w.checked && c.knownRemote(w.actionID) {
+		c.Counts.skipped.Add(1)
+		c.noteAccess(w.actionID)
+		return
+	}
+	if c.SkipExisting && !w.checked {
+		exists, err := c.s3Exists(ctx, w.actionID)
+		if err != nil {
+			c.log.Debug("checking s3 existence; putting anyway", "actionID", w.actionID, "err", err)
+		} else if exists {
+			c.log.Debug("s3 upload skipped; already exists", "actionID", w.actionID)
+			c.Counts.skipped.Add(1)
+			// we didn't refresh it, but it's still in use
+			c.noteAccess(w.actionID)
+			return
+		}
+	}
+	var r io.Reader
+	switch {
+	case w.size == 0:
+		r = bytes.NewReader(nil)
+	case w.readOutput:
+		out, err := c.diskCache.openOutput(w.outputID)
+		if err != nil {
+			c.log.Error("opening output for s3 put", "outputID", w.outputID, "err", err)
+			return
+		}
+		defer out.Close()
+		r = out
+	default:
+		f, err := os.Open(w.diskPath)
+		if err != nil {
+			// TODO: not sure if this shouuld be counted in Counts; those are for s3
+			c.log.Error("opening file for s3 put", "path", w.diskPath, "err", err)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+	err := c.s3Put(ctx, w.actionID, w.outputID, w.size, w.putTime, r)
+	if err != nil {
+		c.log.Debug("putting to s3", "actionID", w.actionID, "outputID", w.outputID, "err", err)
+		return
+	}
+	c.markRemote(w.actionID)
+}
+
+// s3Exists checks whether there's an object for actionID in S3 with a HeadObject.
+func (c *DiskAsyncS3Cache) s3Exists(ctx context.Context, actionID string) (_ bool, retErr error) {
+	actionKey := c.actionKey(actionID)
+	ctx, span := tracer.Start(ctx, "s3.HeadObject", trace.WithAttributes(attribute.String("gocacheprog.key", actionKey)))
+	defer func() { endSpan(span, retErr) }()
+	_, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &c.bucketName,
+		Key:    &actionKey,
+	})
+	if isS3NotFoundError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	c.markRemote(actionID)
+	return true, nil
+}
+
+// markRemote records that actionID is known to exist in S3, so we never upload it again.
+func (c *DiskAsyncS3Cache) markRemote(actionID string) {
+	c.remote.Store(actionID, struct{}{})
+}
+
+func (c *DiskAsyncS3Cache) knownRemote(actionID string) bool {
+	_, ok := c.remote.Load(actionID)
+	return ok
+}
+
+// s3Put puts the object for actionID to S3, recording putTime as the time of the action, unless it's zero.
+func (c *DiskAsyncS3Cache) s3Put(ctx context.Context, actionID, outputID string, size int64, putTime time.Time, body io.Reader) (retErr error) {
 	c.Counts.puts.Add(1)
 	if size == 0 {
 		body = bytes.NewReader(nil)
 	}
-	c.log.Debug("s3 put", "actionID", actionID, "outputID", outputID, "size", size)
+	c.log.DebugContext(ctx, "s3 put", "actionID", actionID, "outputID", outputID, "size", size)
 	actionKey := c.actionKey(actionID)
+	ctx, span := tracer.Start(ctx, "s3.PutObject", trace.WithAttributes(
+		attribute.String("gocacheprog.key", actionKey),
+		attribute.Int64("gocacheprog.size", size),
+	))
+	defer func() { endSpan(span, retErr) }()
+	metadata := map[string]string{
+		outputIDMetadataKey: outputID,
+	}
+	if !putTime.IsZero() {
+		metadata[timeMetadataKey] = strconv.FormatInt(putTime.UnixNano(), 10)
+	}
+	contentLength := size
+	if c.Compression != CompressionNone && size > 0 && size >= c.CompressionMinSize {
+		// next to the output, which is as good a guess as any that there's room
+		f, n, err := c.Compression.compressToTempFile(c.diskCache.dir, "upload-*.tmp", body)
+		if err != nil {
+			c.Counts.putErrors.Add(1)
+			return fmt.Errorf("compressing %s: %w", actionKey, err)
+		}
+		defer func() {
+			f.Close()
+			os.Remove(f.Name())
+		}()
+		c.log.DebugContext(ctx, "s3 put compressed", "actionID", actionID, "size", size, "compressedSize", n)
+		body = f
+		contentLength = n
+		span.SetAttributes(attribute.Int64("gocacheprog.compressed_size", contentLength))
+		metadata[compressionMetadataKey] = string(c.Compression)
+		metadata[rawSizeMetadataKey] = strconv.FormatInt(size, 10)
+	}
 	start := time.Now()
 	_, err := c.s3Client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket:        &c.bucketName,
 		Key:           &actionKey,
 		Body:          body,
-		ContentLength: &size,
-		Metadata: map[string]string{
-			outputIDMetadataKey: outputID,
-		},
+		ContentLength: &contentLength,
+		Metadata:      metadata,
 	})
 	dur := time.Since(start)
 	if err != nil {
 		c.Counts.putErrors.Add(1)
 		return err
 	}
-	c.totalPutBytes.Add(size)
+	c.putLatency.observe(dur)
+	c.putSizes.observe(contentLength)
+	c.totalPutBytes.Add(contentLength)
+	c.totalPutRawBytes.Add(size)
 	c.totalPutDur.Add(dur)
 	return nil
 }
 
-func (c *DiskAsyncS3Cache) s3Get(ctx context.Context, actionID string) (string, int64, io.ReadCloser, error) {
-	c.log.Debug("s3 get", "actionID", actionID)
+// s3Object is an object gotten from S3. Size and Body are of the uncompressed output.
+type s3Object struct {
+	OutputID string
+	Size     int64
+	ETag     string
+	// Time is when the action was put, as in [objectTime]
+	Time time.Time
+	Body io.ReadCloser
+}
+
+// objectTime is when the action of an object was put: its time metadata, or its LastModified if it has none (it was
+// put before we kept the time) or if the metadata is later (the putter's clock was ahead).
+func objectTime(metadata map[string]string, lastModified time.Time) time.Time {
+	nanos, err := strconv.ParseInt(metadata[timeMetadataKey], 10, 64)
+	if err != nil {
+		return lastModified
+	}
+	if t := time.Unix(0, nanos); lastModified.IsZero() || t.Before(lastModified) {
+		return t
+	}
+	return lastModified
+}
+
+// s3Get gets the object for actionID from S3. It returns nil on a miss.
+func (c *DiskAsyncS3Cache) s3Get(ctx context.Context, actionID string) (_ *s3Object, retErr error) {
+	c.log.DebugContext(ctx, "s3 get", "actionID", actionID)
 	c.Counts.gets.Add(1)
 	actionKey := c.actionKey(actionID)
+	ctx, span := tracer.Start(ctx, "s3.GetObject", trace.WithAttributes(attribute.String("gocacheprog.key", actionKey)))
+	defer func() { endSpan(span, retErr) }()
 	start := time.Now()
 	outputResult, getOutputErr := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &c.bucketName,
 		Key:    &actionKey,
 	})
 	dur := time.Since(start)
+	c.getLatency.observe(dur)
 	if isS3NotFoundError(getOutputErr) {
 		c.Counts.misses.Add(1)
-		return "", 0, nil, nil
+		return nil, nil
 	} else if getOutputErr != nil {
 		c.Counts.getErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("unexpected S3 get for %s:  %v", actionKey, getOutputErr)
+		return nil, fmt.Errorf("unexpected S3 get for %s:  %v", actionKey, getOutputErr)
 	}
-	size := *outputResult.ContentLength
-	outputID, ok := outputResult.Metadata[outputIDMetadataKey]
-	if !ok || outputID == "" {
+	obj, err := c.decodeObject(actionKey, outputResult)
+	if err != nil {
 		c.Counts.getErrors.Add(1)
-		return "", 0, nil, fmt.Errorf("outputId not found in metadata")
+		return nil, err
 	}
-	c.log.Debug(fmt.Sprintf("bytes per ms: %d bytes / %d ms = %d B/ms", size, dur.Milliseconds(), size/dur.Milliseconds()))
+	size := *outputResult.ContentLength
+	rawSize := obj.Size
+	c.log.DebugContext(ctx, fmt.Sprintf("bytes per ms: %d bytes / %d ms = %d B/ms", size, dur.Milliseconds(), size/max(dur.Milliseconds(), 1)))
+	c.getSizes.observe(size)
 	c.totalGetBytes.Add(size)
+	c.totalGetRawBytes.Add(rawSize)
 	c.totalGetDur.Add(dur)
 	c.Counts.hits.Add(1)
-	return outputID, size, outputResult.Body, nil
+	c.markRemote(actionID)
+	return obj, nil
+}
+
+// decodeObject checks the metadata of a gotten object and wraps its body to decompress it if need be. On error, it
+// closes the body.
+func (c *DiskAsyncS3Cache) decodeObject(actionKey string, out *s3.GetObjectOutput) (*s3Object, error) {
+	outputID, ok := out.Metadata[outputIDMetadataKey]
+	if !ok || outputID == "" {
+		out.Body.Close()
+		return nil, fmt.Errorf("outputId not found in metadata")
+	}
+	obj := &s3Object{
+		OutputID: outputID,
+		Size:     aws.ToInt64(out.ContentLength),
+		ETag:     aws.ToString(out.ETag),
+		Time:     objectTime(out.Metadata, aws.ToTime(out.LastModified)),
+		Body:     out.Body,
+	}
+	if alg, ok := out.Metadata[compressionMetadataKey]; ok {
+		compression, err := parseCompression(alg)
+		if err != nil {
+			out.Body.Close()
+			return nil, fmt.Errorf("bad compression metadata for %s: %w", actionKey, err)
+		}
+		obj.Size, err = strconv.ParseInt(out.Metadata[rawSizeMetadataKey], 10, 64)
+		if err != nil {
+			out.Body.Close()
+			return nil, fmt.Errorf("bad raw size metadata for %s: %w", actionKey, err)
+		}
+		r, err := compression.NewReader(out.Body)
+		if err != nil {
+			out.Body.Close()
+			return nil, fmt.Errorf("decompressing %s: %w", actionKey, err)
+		}
+		obj.Body = &decompressReadCloser{ReadCloser: r, body: out.Body}
+	}
+	return obj, nil
 }
 
 // Get first attempts to Get the action from the disk cache. If that fails, try the S3 cache. If that succeeds, Put the result in the disk cache. (It may be a little surprising that a Get operation can result in a disk Put.)
@@ -199,51 +495,159 @@ func (c *DiskAsyncS3Cache) Get(ctx context.Context, actionID string) (string, st
 	if !c.started {
 		log.Fatal("not started")
 	}
-	c.log.Debug("get", "actionID", actionID)
+	c.log.DebugContext(ctx, "get", "actionID", actionID)
+	if c.Manifest != "" {
+		c.requested.Store(actionID, struct{}{})
+	}
+	start := time.Now()
 	outputID, diskPath, err := c.diskCache.Get(ctx, actionID)
+	noteTierLatency(ctx, "disk", time.Since(start))
 	if err == nil && outputID != "" {
+		setTier(ctx, "disk")
+		c.noteAccess(actionID)
+		if _, ok := c.prefetched.Load(actionID); ok && c.coaccess != nil {
+			c.coaccessHit(actionID)
+		}
 		return outputID, diskPath, nil
 	}
-	outputID, size, output, err := c.s3Get(ctx, actionID)
+	start = time.Now()
+	outputID, diskPath, err = c.fill(ctx, actionID)
+	noteTierLatency(ctx, "s3", time.Since(start))
+	if err == nil && outputID != "" {
+		setTier(ctx, "s3")
+		c.noteAccess(actionID)
+		if c.coaccess != nil {
+			c.coaccessHit(actionID)
+		}
+	}
+	return outputID, diskPath, err
+}
+
+// prefetchFill is fill for actions nobody has asked for yet. It remembers them, so that Get can tell a hit on a
+// prefetched action (which would have been a remote hit) from a plain local hit.
+func (c *DiskAsyncS3Cache) prefetchFill(ctx context.Context, actionID string) (string, string, error) {
+	outputID, diskPath, err := c.fill(ctx, actionID)
+	if err == nil && outputID != "" {
+		c.prefetched.Store(actionID, struct{}{})
+	}
+	return outputID, diskPath, err
+}
+
+// fill gets actionID from S3 and puts it in the disk cache. It returns zero values on a miss.
+// Concurrent fills of the same action are coalesced into one.
+func (c *DiskAsyncS3Cache) fill(ctx context.Context, actionID string) (string, string, error) {
+	type filled struct{ outputID, diskPath string }
+	var led bool
+	v, err, _ := c.fills.Do(actionID, func() (any, error) {
+		led = true
+		// the fill is shared, so it can't stop when the request that happened to lead it does (e.g. its client
+		// hanging up on the daemon)
+		outputID, diskPath, err := c.fillOnce(context.WithoutCancel(ctx), actionID)
+		return filled{outputID, diskPath}, err
+	})
+	if !led {
+		c.log.DebugContext(ctx, "fill coalesced", "actionID", actionID)
+		c.Counts.coalesced.Add(1)
+	}
 	if err != nil {
 		return "", "", err
 	}
-	// TODO: document when/why this happens
-	if outputID == "" {
+	f := v.(filled)
+	return f.outputID, f.diskPath, nil
+}
+
+func (c *DiskAsyncS3Cache) fillOnce(ctx context.Context, actionID string) (_, _ string, retErr error) {
+	ctx, span := tracer.Start(ctx, "fill")
+	defer func() { endSpan(span, retErr) }()
+	// only one process sharing the disk cache needs to download it
+	unlock, err := c.diskCache.lock("a-" + actionID)
+	if err != nil {
+		return "", "", fmt.Errorf("locking %s: %w", actionID, err)
+	}
+	defer unlock()
+	if outputID, diskPath := c.diskCache.lookup(actionID); outputID != "" {
+		c.log.DebugContext(ctx, "filled by someone else while we waited", "actionID", actionID)
+		return outputID, diskPath, nil
+	}
+	obj, err := c.s3Get(ctx, actionID)
+	if err != nil {
+		return "", "", err
+	}
+	if obj == nil {
+		// a miss in both
 		return "", "", nil
 	}
-	diskPath, err = c.diskCache.Put(ctx, actionID, outputID, size, output)
+	defer obj.Body.Close()
+	// the entry is marked as filled from S3 so that we never upload it back
+	diskPath, err := c.diskCache.putWithOrigin(ctx, actionID, obj.OutputID, obj.Size, obj.Body, originRemote, obj.ETag)
 	if err != nil {
 		return "", "", err
 	}
-	return outputID, diskPath, nil
+	return obj.OutputID, diskPath, nil
 }
 
 // Put first puts to the disk cache, then queues the work to put to the S3 cache. It returns the path on disk.
-// TODO: there's a problem when the disk and s3 get out of sync: if the disk has a file that the s3 doesn't, it will never get put to s3. This is maybe fine, since eventually the disk cache will be cleared?
+// If the disk and s3 get out of sync (the disk has an entry that s3 doesn't), [DiskAsyncS3Cache.Backfill] puts it right.
 func (c *DiskAsyncS3Cache) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (string, error) {
 	if !c.started {
 		log.Fatal("not started")
 	}
-	c.log.Debug("put", "actionID", actionID, "outputID", outputID, "size", size)
+	c.log.DebugContext(ctx, "put", "actionID", actionID, "outputID", outputID, "size", size)
 	// special case for empty files, nead empty reader
 	if size == 0 {
 		body = bytes.NewReader(nil)
 	}
 
-	diskPath, err := c.diskCache.Put(ctx, actionID, outputID, size, body)
+	// If we filled this very entry from S3 (in this run or an earlier one that used the same disk), there's no need to upload it.
+	// We keep it marked as remote, so that it stays that way.
+	origin, etag := originLocal, ""
+	if ie, ok := c.diskCache.entry(actionID); ok && ie.Origin == originRemote && ie.OutputID == outputID {
+		origin, etag = originRemote, ie.ETag
+	}
+	start := time.Now()
+	putTime := start
+	diskPath, err := c.diskCache.putWithOrigin(ctx, actionID, outputID, size, body, origin, etag)
+	noteTierLatency(ctx, "disk", time.Since(start))
 	if err != nil {
 		return "", fmt.Errorf("local cache put failed: %w", err)
 	}
+	if origin == originRemote {
+		c.log.DebugContext(ctx, "s3 upload skipped; filled from s3", "actionID", actionID, "etag", etag)
+		c.Counts.skipped.Add(1)
+		return diskPath, nil
+	}
+	if c.knownRemote(actionID) {
+		c.log.DebugContext(ctx, "s3 upload skipped; known to exist", "actionID", actionID)
+		c.Counts.skipped.Add(1)
+		c.noteAccess(actionID)
+		return diskPath, nil
+	}
+	start = time.Now()
 	c.work <- putWork{
 		actionID: actionID,
 		outputID: outputID,
 		size:     size,
 		diskPath: diskPath,
+		putTime:  putTime,
+		spanCtx:  trace.SpanContextFromContext(ctx),
 	}
+	c.queueWaitNanos.Add(int64(time.Since(start)))
+	c.noteQueueDepth()
+	noteUploadQueued(ctx)
 	return diskPath, nil
 }
 
+// noteQueueDepth updates maxQueueDepth after queueing an upload.
+func (c *DiskAsyncS3Cache) noteQueueDepth() {
+	depth := int64(len(c.work))
+	for {
+		m := c.maxQueueDepth.Load()
+		if depth <= m || c.maxQueueDepth.CompareAndSwap(m, depth) {
+			return
+		}
+	}
+}
+
 // Close closes the disk cache and waits for all workers to drain the work queue.
 func (c *DiskAsyncS3Cache) Close() error {
 	if !c.started {
@@ -251,13 +655,32 @@ func (c *DiskAsyncS3Cache) Close() error {
 	}
 	c.log.Debug("close")
 	var errAll error
-	if err := c.diskCache.Close(); err != nil {
-		errAll = errors.Join(fmt.Errorf("local cache stop failed: %w", err), errAll)
-	}
+	// background work feeds the work queue, so it has to stop before we close it
+	c.bgCancel()
+	c.bgWG.Wait()
 	// TODO: this means we wait till all the s3 workers finish; we may want to just abandon the rest of the work (or offer a mode)
 	close(c.work)
 	c.log.Debug("waiting for s3 workers to finish")
 	c.wg.Wait()
+	if c.Manifest != "" {
+		if err := c.putManifest(context.Background()); err != nil {
+			errAll = errors.Join(fmt.Errorf("putting manifest: %w", err), errAll)
+		}
+	}
+	if c.coaccess != nil {
+		if err := c.putCoaccess(context.Background()); err != nil {
+			errAll = errors.Join(fmt.Errorf("putting co-access index: %w", err), errAll)
+		}
+	}
+	if c.RecordAccess {
+		if err := c.putAccessMarker(context.Background()); err != nil {
+			errAll = errors.Join(fmt.Errorf("putting access marker: %w", err), errAll)
+		}
+	}
+	// the workers read from the disk cache, so close it last
+	if err := c.diskCache.Close(); err != nil {
+		errAll = errors.Join(fmt.Errorf("local cache stop failed: %w", err), errAll)
+	}
 	return errAll
 }
 
@@ -270,7 +693,8 @@ func isS3NotFoundError(err error) bool {
 		var ae smithy.APIError
 		if errors.As(err, &ae) {
 			code := ae.ErrorCode()
-			if code == "NoSuchKey" {
+			// HeadObject has no body to put an error code in, so it's just NotFound
+			if code == "NoSuchKey" || code == "NotFound" {
 				return true
 			}
 			if code == "AccessDenied" {
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// runRequests is what a run asked the cache for, read from its access log or manifest.
+type runRequests struct {
+	Name string `json:"name"`
+	// HasOutcomes is whether we know which tier served each get, i.e. it's from an access log, not a manifest
+	HasOutcomes bool `json:"hasOutcomes"`
+	Gets        int  `json:"gets"`
+	DiskHits    int  `json:"diskHits"`
+	S3Hits      int  `json:"s3Hits"`
+	Misses      int  `json:"misses"`
+	// tiers maps the actionIDs gotten to the tier that served them the first time ("" on a miss)
+	tiers map[string]string
+}
+
+// readRunRequests reads an access log (see -access-log) or a manifest (see -manifest), telling them apart by the
+// first line. If an action was gotten more than once, its first get counts.
+func readRunRequests(file string) (*runRequests, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	first, err := br.Peek(1)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	run := &runRequests{Name: file, tiers: make(map[string]string)}
+	if !bytes.Equal(first, []byte("{")) {
+		actionIDs, err := readActionIDs(br)
+		if err != nil {
+			return nil, err
+		}
+		for _, actionID := range actionIDs {
+			if _, ok := run.tiers[actionID]; !ok {
+				run.tiers[actionID] = ""
+				run.Gets++
+			}
+		}
+		return run, nil
+	}
+	run.HasOutcomes = true
+	dec := json.NewDecoder(br)
+	for {
+		var r accessRecord
+		if err := dec.Decode(&r); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if r.Command != "get" || r.ActionID == "" {
+			continue
+		}
+		if _, ok := run.tiers[r.ActionID]; ok {
+			continue
+		}
+		tier := r.Tier
+		if r.Miss || r.Error != "" {
+			tier = ""
+		}
+		run.tiers[r.ActionID] = tier
+		run.Gets++
+		switch tier {
+		case "disk":
+			run.DiskHits++
+		case "s3":
+			run.S3Hits++
+		default:
+			run.Misses++
+		}
+	}
+	return run, nil
+}
+
+// explanation compares the requests of a base run and a new one.
+type explanation struct {
+	Base *runRequests `json:"base"`
+	New  *runRequests `json:"new"`
+	// Both, OnlyNew and OnlyBase are the actions requested by both runs, just the new one, and just the base one
+	Both     int      `json:"both"`
+	OnlyNew  []string `json:"onlyNew"`
+	OnlyBase []string `json:"onlyBase"`
+	// NewMisses are the new run's misses on actions the base run didn't request: their inputs changed.
+	// OldMisses are its misses on actions the base run requested too: they weren't in the cache (e.g. evicted, or
+	// never uploaded). Both are empty unless the new run is from an access log.
+	NewMisses []string `json:"newMisses"`
+	OldMisses []string `json:"oldMisses"`
+}
+
+func explain(base, next *runRequests) *explanation {
+	e := &explanation{Base: base, New: next, OnlyNew: []string{}, OnlyBase: []string{}, NewMisses: []string{}, OldMisses: []string{}}
+	for actionID, tier := range next.tiers {
+		_, inBase := base.tiers[actionID]
+		if inBase {
+			e.Both++
+		} else {
+			e.OnlyNew = append(e.OnlyNew, actionID)
+		}
+		if !next.HasOutcomes || tier != "" {
+			continue
+		}
+		if inBase {
+			e.OldMisses = append(e.OldMisses, actionID)
+		} else {
+			e.NewMisses = append(e.NewMisses, actionID)
+		}
+	}
+	for actionID := range base.tiers {
+		if _, ok := next.tiers[actionID]; !ok {
+			e.OnlyBase = append(e.OnlyBase, actionID)
+		}
+	}
+	for _, ids := range [][]string{e.OnlyNew, e.OnlyBase, e.NewMisses, e.OldMisses} {
+		slices.Sort(ids)
+	}
+	return e
+}
+
+// percent is n as a percentage of total.
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func (r *runRequests) summary() string {
+	if !r.HasOutcomes {
+		return fmt.Sprintf("%s: %d actions", r.Name, r.Gets)
+	}
+	return fmt.Sprintf("%s: %d gets: %d disk hits (%.1f%%), %d s3 hits (%.1f%%), %d misses (%.1f%%)", r.Name, r.Gets,
+		r.DiskHits, percent(r.DiskHits, r.Gets), r.S3Hits, percent(r.S3Hits, r.Gets), r.Misses, percent(r.Misses, r.Gets))
+}
+
+func (e *explanation) write(w io.Writer, list bool) {
+	fmt.Fprintf(w, "base: %s\nnew:  %s\n", e.Base.summary(), e.New.summary())
+	if e.Base.HasOutcomes && e.New.HasOutcomes {
+		delta := func(n func(*runRequests) int) float64 {
+			return percent(n(e.New), e.New.Gets) - percent(n(e.Base), e.Base.Gets)
+		}
+		fmt.Fprintf(w, "hit rate change: disk %+.1f points, s3 %+.1f points, misses %+.1f points\n",
+			delta(func(r *runRequests) int { return r.DiskHits }),
+			delta(func(r *runRequests) int { return r.S3Hits }),
+			delta(func(r *runRequests) int { return r.Misses }))
+	}
+	fmt.Fprintf(w, "%d actions requested by both, %d only by new, %d only by base\n", e.Both, len(e.OnlyNew), len(e.OnlyBase))
+	if e.New.HasOutcomes {
+		fmt.Fprintf(w, "new misses: %d on actions base didn't request (their inputs changed), %d on actions base requested too (not in the cache)\n",
+			len(e.NewMisses), len(e.OldMisses))
+	}
+	if !list {
+		return
+	}
+	sections := []struct {
+		title string
+		ids   []string
+	}{
+		{"missed, not requested by base", e.NewMisses},
+		{"missed, requested by base too", e.OldMisses},
+		{"requested only by new", e.OnlyNew},
+		{"requested only by base", e.OnlyBase},
+	}
+	for _, s := range sections {
+		if len(s.ids) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", s.title)
+		for _, id := range s.ids {
+			fmt.Fprintf(w, "  %s\n", id)
+		}
+	}
+}
+
+// runExplain implements the explain subcommand, which compares what two runs (e.g. two CI runs of the same commit)
+// asked the cache for, to help find out why one missed more than the other. It doesn't need S3.
+func runExplain(args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	list := fs.Bool("list", false, "list the actionIDs in each category")
+	asJSON := fs.Bool("json", false, "write the comparison as JSON, with all the actionIDs")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: explain [flags] <base> <new>\n\nbase and new are access logs (see -access-log) or manifests (see -manifest) of two runs.\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("explain: want two access logs or manifests")
+	}
+	base, err := readRunRequests(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	next, err := readRunRequests(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	e := explain(base, next)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	}
+	e.write(os.Stdout, *list)
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"golang.org/x/sync/errgroup"
+)
+
+// maxDeleteBatch is the most keys DeleteObjects takes at once
+const maxDeleteBatch = 1000
+
+// GCOptions configures [DiskAsyncS3Cache.GC].
+type GCOptions struct {
+	// MaxIdle, if set, deletes entries that haven't been used (put or hit) for this long.
+	MaxIdle time.Duration
+	// MaxBytes, if set, then deletes the least recently used entries until the rest fit in this many bytes.
+	MaxBytes int64
+	// DryRun only reports what would be deleted.
+	DryRun bool
+	// Parallel is the number of listings and reads to run at once.
+	Parallel int
+}
+
+// GCResult counts what a gc found and deleted.
+type GCResult struct {
+	Objects        int64
+	Bytes          int64
+	Expired        int64
+	ExpiredBytes   int64
+	Evicted        int64
+	EvictedBytes   int64
+	Deleted        int64
+	MarkersDeleted int64
+}
+
+// gcEntry is an action object in S3 and when it was last used
+type gcEntry struct {
+	remoteObject
+	lastUsed time.Time
+}
+
+// GC deletes action objects from S3 that are idle for longer than opts.MaxIdle, then the least recently used ones
+// until the rest fit in opts.MaxBytes. An entry was last used when it was put, or when it was last hit by a run with
+// RecordAccess, according to the access markers. It was put at its LastModified, unless an import put it: then it was
+// put at the time in its metadata (see [objectTime]). Access and import markers older than MaxIdle are deleted too,
+// since everything they could keep or expire is past MaxIdle anyway, and so are the co-access groups of all but the
+// latest runs, which are never loaded. It doesn't need [Start].
+func (c *DiskAsyncS3Cache) GC(ctx context.Context, opts GCOptions) (GCResult, error) {
+	var res GCResult
+	lastAccess, markers, err := c.lastAccesses(ctx, opts.Parallel)
+	if err != nil {
+		return res, err
+	}
+	lastImport, importMarkers, err := c.readMarkers(ctx, importPath, opts.Parallel)
+	if err != nil {
+		return res, err
+	}
+	markers = append(markers, importMarkers...)
+	var entries []gcEntry
+	var mu sync.Mutex
+	now := time.Now()
+	cutoff := now.Add(-opts.MaxIdle)
+	// unsure are the imported entries that only their put time can expire. It's in the metadata, which listings don't
+	// have, so we head them after.
+	var unsure []int
+	err = c.listActions(ctx, opts.Parallel, func(o remoteObject) error {
+		actionID := path.Base(o.Key)
+		e := gcEntry{remoteObject: o, lastUsed: o.LastModified}
+		t := lastAccess[actionID]
+		if t.After(e.lastUsed) {
+			e.lastUsed = t
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		// the marker is put after the upload, so if it's older, the object was put again since
+		imported := !lastImport[actionID].Before(o.LastModified)
+		if opts.MaxIdle > 0 && imported && e.lastUsed.After(cutoff) && !t.After(cutoff) {
+			unsure = append(unsure, len(entries))
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(opts.Parallel, 1))
+	for _, i := range unsure {
+		g.Go(func() error {
+			e := &entries[i]
+			out, err := c.s3Client.HeadObject(gctx, &s3.HeadObjectInput{
+				Bucket: &c.bucketName,
+				Key:    &e.Key,
+			})
+			if isS3NotFoundError(err) {
+				// deleted since we listed it
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("heading %s: %w", e.Key, err)
+			}
+			putTime := objectTime(out.Metadata, e.LastModified)
+			if t := lastAccess[path.Base(e.Key)]; t.After(putTime) {
+				putTime = t
+			}
+			e.lastUsed = putTime
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return res, err
+	}
+	slices.SortFunc(entries, func(a, b gcEntry) int { return a.lastUsed.Compare(b.lastUsed) })
+
+	var doomed []string
+	kept := int64(0)
+	for _, e := range entries {
+		res.Objects++
+		res.Bytes += e.Size
+		if opts.MaxIdle > 0 && now.Sub(e.lastUsed) > opts.MaxIdle {
+			res.Expired++
+			res.ExpiredBytes += e.Size
+			doomed = append(doomed, e.Key)
+			c.log.Debug("gc: expired", "key", e.Key, "lastUsed", e.lastUsed)
+		} else {
+			kept += e.Size
+		}
+	}
+	if opts.MaxBytes > 0 {
+		// entries are oldest first, and the expired ones are at the start
+		for _, e := range entries[res.Expired:] {
+			if kept <= opts.MaxBytes {
+				break
+			}
+			res.Evicted++
+			res.EvictedBytes += e.Size
+			kept -= e.Size
+			doomed = append(doomed, e.Key)
+			c.log.Debug("gc: evicted", "key", e.Key, "lastUsed", e.lastUsed)
+		}
+	}
+	var staleMarkers []string
+	if opts.MaxIdle > 0 {
+		for _, m := range markers {
+			if now.Sub(m.LastModified) > opts.MaxIdle {
+				staleMarkers = append(staleMarkers, m.Key)
+			}
+		}
+	}
+	runs := 0
+	err = c.listCoaccess(ctx, func(o remoteObject) error {
+		if runs++; runs > coaccessRuns {
+			staleMarkers = append(staleMarkers, o.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if opts.DryRun {
+		return res, nil
+	}
+	n, err := c.deleteObjects(ctx, doomed)
+	res.Deleted = n
+	if err != nil {
+		return res, err
+	}
+	res.MarkersDeleted, err = c.deleteObjects(ctx, staleMarkers)
+	return res, err
+}
+
+// deleteObjects deletes keys in batches, returning how many were deleted.
+func (c *DiskAsyncS3Cache) deleteObjects(ctx context.Context, keys []string) (int64, error) {
+	var deleted int64
+	for batch := range slices.Chunk(keys, maxDeleteBatch) {
+		ids := make([]types.ObjectIdentifier, len(batch))
+		for i, key := range batch {
+			ids[i] = types.ObjectIdentifier{Key: aws.String(key)}
+		}
+		out, err := c.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: &c.bucketName,
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		// in quiet mode, only the failures are listed
+		deleted += int64(len(batch) - len(out.Errors))
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return deleted, fmt.Errorf("deleting %d objects failed, e.g. %s: %s", len(out.Errors), aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+	}
+	return deleted, nil
+}
+
+// byteSize is a flag.Value for a number of bytes, with an optional K, M, G or T suffix (powers of 1000).
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(s string) error {
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if rest, ok := strings.CutSuffix(strings.ToUpper(s), suffix); ok {
+			s = rest
+			for range i + 1 {
+				mult *= 1000
+			}
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("bad size %q", s)
+	}
+	*b = byteSize(n * float64(mult))
+	return nil
+}
+
+// runGC implements the gc subcommand, which expires old entries from S3 and keeps it within a size budget.
+func runGC(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	maxIdle := fs.Duration("max-idle", 0, "delete entries not used for this long, e.g. 720h (0=no limit)")
+	var maxBytes byteSize
+	fs.Var(&maxBytes, "max-bytes", "then delete the least recently used entries until the rest fit in this size, e.g. 500G (0=no limit)")
+	dryRun := fs.Bool("dry-run", false, "only report what would be deleted")
+	parallel := fs.Int("parallel", 16, "number of listings and reads to run at once")
+	fs.Parse(args)
+	if *maxIdle == 0 && maxBytes == 0 {
+		return fmt.Errorf("gc: set -max-idle and/or -max-bytes")
+	}
+
+	res, err := cacher.GC(ctx, GCOptions{MaxIdle: *maxIdle, MaxBytes: int64(maxBytes), DryRun: *dryRun, Parallel: *parallel})
+	fmt.Fprintf(os.Stderr, "gc: %d entries, %s: %d expired (%s), %d evicted (%s)",
+		res.Objects, formatBytes(float64(res.Bytes)), res.Expired, formatBytes(float64(res.ExpiredBytes)),
+		res.Evicted, formatBytes(float64(res.EvictedBytes)))
+	if *dryRun {
+		fmt.Fprintln(os.Stderr, "; dry run, so nothing deleted")
+	} else {
+		fmt.Fprintf(os.Stderr, "; %d deleted, and %d stale access markers\n", res.Deleted, res.MarkersDeleted)
+	}
+	return err
+}
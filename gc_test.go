@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+type fakeObject struct {
+	body         []byte
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+// fakeS3 is an in-memory bucket. It implements the parts of s3Client that the tests use; the rest panic.
+type fakeS3 struct {
+	s3Client
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// heads counts HeadObject calls
+	heads int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string]fakeObject)}
+}
+
+func (f *fakeS3) put(key string, size int, lastModified time.Time) {
+	f.objects[key] = fakeObject{body: make([]byte, size), lastModified: lastModified}
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	return &s3.GetObjectOutput{
+		Body:          io.NopCloser(bytes.NewReader(o.body)),
+		ContentLength: aws.Int64(int64(len(o.body))),
+		Metadata:      o.metadata,
+		LastModified:  aws.Time(o.lastModified),
+	}, nil
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[*params.Key] = fakeObject{body: body, metadata: params.Metadata, lastModified: time.Now()}
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.heads++
+	o, ok := f.objects[*params.Key]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NotFound"}
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(o.body))),
+		Metadata:      o.metadata,
+		LastModified:  aws.Time(o.lastModified),
+	}, nil
+}
+
+func (f *fakeS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := &s3.ListObjectsV2Output{}
+	for _, k := range slices.Sorted(func(yield func(string) bool) {
+		for k := range f.objects {
+			if !yield(k) {
+				return
+			}
+		}
+	}) {
+		if !strings.HasPrefix(k, aws.ToString(params.Prefix)) {
+			continue
+		}
+		o := f.objects[k]
+		out.Contents = append(out.Contents, types.Object{
+			Key:          aws.String(k),
+			Size:         aws.Int64(int64(len(o.body))),
+			LastModified: aws.Time(o.lastModified),
+		})
+	}
+	return out, nil
+}
+
+func (f *fakeS3) CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// the source is <bucket>/<key>
+	_, src, _ := strings.Cut(*params.CopySource, "/")
+	o, ok := f.objects[src]
+	if !ok {
+		return nil, &smithy.GenericAPIError{Code: "NoSuchKey"}
+	}
+	o.lastModified = time.Now()
+	f.objects[*params.Key] = o
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, o := range params.Delete.Objects {
+		delete(f.objects, *o.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func TestGC(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	id := func(i int) string { return fmt.Sprintf("%064x", i) }
+
+	newBucket := func() *fakeS3 {
+		f := newFakeS3()
+		// idle too long
+		f.put("p/"+id(1), 10, now.Add(-100*day))
+		// put long ago, but hit 2 days ago
+		f.put("p/"+id(2), 50, now.Add(-100*day))
+		f.objects["p/_access/recent"] = fakeObject{body: []byte(id(2) + "\n"), lastModified: now.Add(-2 * day)}
+		f.objects["p/_access/stale"] = fakeObject{body: []byte(id(3) + "\n"), lastModified: now.Add(-40 * day)}
+		// the least recently used of the rest
+		f.put("p/"+id(3), 100, now.Add(-5*day))
+		f.put("p/"+id(4), 100, now.Add(-12*time.Hour))
+		// imported yesterday, but put long ago
+		f.objects["p/"+id(6)] = fakeObject{
+			body:         make([]byte, 10),
+			metadata:     map[string]string{timeMetadataKey: strconv.FormatInt(now.Add(-100*day).UnixNano(), 10)},
+			lastModified: now.Add(-day),
+		}
+		f.objects["p/_imports/recent"] = fakeObject{body: []byte(id(6) + "\n"), lastModified: now.Add(-day + time.Minute)}
+		// another cache's objects under a prefix that listing p/fe finds too
+		f.put("p/feature-x/"+id(5), 10, now.Add(-100*day))
+		f.put("p/fe-notes", 10, now.Add(-100*day))
+		return f
+	}
+	opts := GCOptions{MaxIdle: 30 * day, MaxBytes: 150, Parallel: 4}
+
+	t.Run("dry run", func(t *testing.T) {
+		f := newBucket()
+		c := NewDiskAsyncS3Cache(nil, f, "bucket", "p", 1, 1)
+		res, err := c.GC(context.Background(), GCOptions{MaxIdle: opts.MaxIdle, MaxBytes: opts.MaxBytes, Parallel: 4, DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Objects != 5 || res.Expired != 2 || res.Evicted != 1 || res.Deleted != 0 {
+			t.Errorf("got %+v, want 5 objects, 2 expired, 1 evicted, none deleted", res)
+		}
+		if len(f.keys()) != 10 {
+			t.Errorf("dry run deleted objects: %v", f.keys())
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		f := newBucket()
+		c := NewDiskAsyncS3Cache(nil, f, "bucket", "p", 1, 1)
+		res, err := c.GC(context.Background(), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := GCResult{
+			Objects:        5,
+			Bytes:          270,
+			Expired:        2,
+			ExpiredBytes:   20,
+			Evicted:        1,
+			EvictedBytes:   100,
+			Deleted:        3,
+			MarkersDeleted: 1,
+		}
+		if res != want {
+			t.Errorf("got %+v, want %+v", res, want)
+		}
+		// only the imported entry needs its put time
+		if f.heads != 1 {
+			t.Errorf("headed %d objects, want 1", f.heads)
+		}
+		wantKeys := []string{"p/" + id(2), "p/" + id(4), "p/_access/recent", "p/_imports/recent", "p/fe-notes", "p/feature-x/" + id(5)}
+		slices.Sort(wantKeys)
+		if got := f.keys(); !slices.Equal(got, wantKeys) {
+			t.Errorf("left %v, want %v", got, wantKeys)
+		}
+	})
+}
+
+// TestGCBackfilled checks that an old disk entry that's backfilled lives as long as a new one, instead of being
+// expired by gc and uploaded again by the next backfill.
+func TestGCBackfilled(t *testing.T) {
+	ctx := context.Background()
+	f := newFakeS3()
+	dc := NewDiskCache(t.TempDir())
+	if err := dc.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	actionID := fmt.Sprintf("%064x", 1)
+	body := []byte("old output")
+	_, outputID, err := hashOutput(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ie := indexEntry{
+		Version:   1,
+		OutputID:  outputID,
+		Size:      int64(len(body)),
+		TimeNanos: time.Now().Add(-100 * 24 * time.Hour).UnixNano(),
+	}
+	if err := dc.putEntry(actionID, ie, bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewDiskAsyncS3Cache(dc, f, "bucket", "p", 4, 1)
+	if err := c.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res, err := c.Backfill(ctx, BackfillOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Queued != 1 {
+		t.Fatalf("backfill queued %d, want 1", res.Queued)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gc, err := c.GC(ctx, GCOptions{MaxIdle: 30 * 24 * time.Hour, Parallel: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc.Expired != 0 {
+		t.Errorf("gc expired %d backfilled entries, want 0", gc.Expired)
+	}
+	o, ok := f.objects["p/"+actionID]
+	if !ok {
+		t.Fatal("backfilled entry was deleted")
+	}
+	if put := objectTime(o.metadata, o.lastModified); time.Since(put) > time.Hour {
+		t.Errorf("backfilled entry was put at %v, want the upload time", put)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/wire"
 )
@@ -53,19 +54,139 @@ type Process struct {
 	// shutting down.
 	Close func() error
 
+	// StartRequest optionally specifies a func to call when a request comes
+	// in, before it's handled, e.g. to start a tracing span. The returned
+	// context is passed to Get/Put, and the returned func is called with the
+	// response and error once the request has been handled.
+	StartRequest func(ctx context.Context, req *wire.Request) (context.Context, func(*wire.Response, error))
+
+	// MaxConcurrentGets and MaxConcurrentPuts optionally limit how many gets
+	// and puts are handled at once; zero means no limit. Gets over the limit
+	// wait their turn. Put bodies are held in memory until they're handled, so
+	// a put over the limit stops the reading of requests altogether until a
+	// slot frees up, which pushes back on cmd/go.
+	MaxConcurrentGets int
+	MaxConcurrentPuts int
+
+	// Limits optionally specifies limits shared with other Processes, e.g.
+	// the clients of a daemon, to use instead of MaxConcurrentGets and
+	// MaxConcurrentPuts. The queueing metrics below are still this Process's
+	// own.
+	Limits *Limits
+
 	Gets      atomic.Int64
 	GetHits   atomic.Int64
 	GetMisses atomic.Int64
 	GetErrors atomic.Int64
 	Puts      atomic.Int64
 	PutErrors atomic.Int64
+
+	// GetsInFlight and PutsInFlight are the number of gets and puts being
+	// handled now, not counting those waiting for a slot.
+	GetsInFlight atomic.Int64
+	PutsInFlight atomic.Int64
+
+	// Queueing metrics for the limits above: the number of requests waiting
+	// now, the most that were ever waiting at once, and the total time spent
+	// waiting.
+	GetsWaiting    atomic.Int64
+	MaxGetsWaiting atomic.Int64
+	GetWaitNanos   atomic.Int64
+	PutsWaiting    atomic.Int64
+	MaxPutsWaiting atomic.Int64
+	PutWaitNanos   atomic.Int64
+}
+
+type requestIDKey struct{}
+
+// RequestID returns the ID of the request that ctx is for, if any. The
+// contexts passed to Get and Put have one.
+func RequestID(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(int64)
+	return id, ok
+}
+
+// Limits limits how many gets and puts are handled at once by all the
+// Processes that share it.
+type Limits struct {
+	gets, puts chan struct{}
+}
+
+// NewLimits returns Limits of maxGets gets and maxPuts puts at once; zero
+// means no limit.
+func NewLimits(maxGets, maxPuts int) *Limits {
+	l := &Limits{}
+	if maxGets > 0 {
+		l.gets = make(chan struct{}, maxGets)
+	}
+	if maxPuts > 0 {
+		l.puts = make(chan struct{}, maxPuts)
+	}
+	return l
+}
+
+// limiter is a counting semaphore that keeps queueing metrics. A nil
+// *limiter doesn't limit anything.
+type limiter struct {
+	sem        chan struct{}
+	waiting    *atomic.Int64
+	maxWaiting *atomic.Int64
+	waitNanos  *atomic.Int64
+}
+
+func newLimiter(sem chan struct{}, waiting, maxWaiting, waitNanos *atomic.Int64) *limiter {
+	if sem == nil {
+		return nil
+	}
+	return &limiter{
+		sem:        sem,
+		waiting:    waiting,
+		maxWaiting: maxWaiting,
+		waitNanos:  waitNanos,
+	}
 }
 
+func (l *limiter) acquire() {
+	if l == nil {
+		return
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return
+	default:
+	}
+	start := time.Now()
+	w := l.waiting.Add(1)
+	for {
+		m := l.maxWaiting.Load()
+		if w <= m || l.maxWaiting.CompareAndSwap(m, w) {
+			break
+		}
+	}
+	l.sem <- struct{}{}
+	l.waiting.Add(-1)
+	l.waitNanos.Add(int64(time.Since(start)))
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
+
+// Run serves the protocol over stdin and stdout, as cmd/go expects of a GOCACHEPROG.
 func (p *Process) Run() error {
-	br := bufio.NewReader(os.Stdin)
+	return p.Serve(os.Stdin, os.Stdout)
+}
+
+// Serve serves the protocol, reading requests from r and writing responses to w, until r hits EOF.
+// It waits for in-flight requests to be answered before returning.
+func (p *Process) Serve(r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
 	jd := json.NewDecoder(br)
 
-	bw := bufio.NewWriter(os.Stdout)
+	bw := bufio.NewWriter(w)
 	je := json.NewEncoder(bw)
 
 	var caps []wire.Cmd
@@ -83,11 +204,21 @@ func (p *Process) Run() error {
 		return err
 	}
 
-	var wmu sync.Mutex // guards writing responses
+	limits := p.Limits
+	if limits == nil {
+		limits = NewLimits(p.MaxConcurrentGets, p.MaxConcurrentPuts)
+	}
+	getLimit := newLimiter(limits.gets, &p.GetsWaiting, &p.MaxGetsWaiting, &p.GetWaitNanos)
+	putLimit := newLimiter(limits.puts, &p.PutsWaiting, &p.MaxPutsWaiting, &p.PutWaitNanos)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	var wmu sync.Mutex // guards writing responses
+	var wg sync.WaitGroup
+	// before cancel, so requests in flight at EOF finish
+	defer wg.Wait()
+
 	for {
 		var req wire.Request
 		if err := jd.Decode(&req); err != nil {
@@ -96,24 +227,46 @@ func (p *Process) Run() error {
 			}
 			return err
 		}
+		// the put slot is taken before reading the body, so that we don't hold more than the limit's worth of bodies
+		var limit *limiter
+		if req.Command == wire.CmdPut {
+			limit = putLimit
+			limit.acquire()
+		}
 		if req.Command == wire.CmdPut && req.BodySize > 0 {
 			// TODO(bradfitz): stream this and pass a checksum-validating
 			// io.Reader that validates on EOF.
 			var bodyb []byte
+			// these used to be fatal, but with a shared daemon one bad client shouldn't take everyone down
 			if err := jd.Decode(&bodyb); err != nil {
-				log.Fatal(err)
+				return fmt.Errorf("decoding put body: %w", err)
 			}
 			if int64(len(bodyb)) != req.BodySize {
-				log.Fatalf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
+				return fmt.Errorf("only got %d bytes of declared %d", len(bodyb), req.BodySize)
 			}
 			req.Body = bytes.NewReader(bodyb)
 		}
+		wg.Add(1)
 		go func() {
+			defer wg.Done()
+			ctx := context.WithValue(ctx, requestIDKey{}, req.ID)
+			var done func(*wire.Response, error)
+			if p.StartRequest != nil {
+				ctx, done = p.StartRequest(ctx, &req)
+			}
+			if req.Command == wire.CmdGet {
+				limit = getLimit
+				limit.acquire()
+			}
 			res := &wire.Response{ID: req.ID}
-			ctx := ctx // TODO: include req ID as a context.Value for tracing?
-			if err := p.handleRequest(ctx, &req, res); err != nil {
+			err := p.handleRequest(ctx, &req, res)
+			if err != nil {
 				res.Err = err.Error()
 			}
+			limit.release()
+			if done != nil {
+				done(res, err)
+			}
 			wmu.Lock()
 			defer wmu.Unlock()
 			je.Encode(res)
@@ -140,6 +293,8 @@ func (p *Process) handleRequest(ctx context.Context, req *wire.Request, res *wir
 
 func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
 	p.Gets.Add(1)
+	p.GetsInFlight.Add(1)
+	defer p.GetsInFlight.Add(-1)
 	defer func() {
 		if retErr != nil {
 			p.GetErrors.Add(1)
@@ -189,6 +344,8 @@ func (p *Process) handleGet(ctx context.Context, req *wire.Request, res *wire.Re
 func (p *Process) handlePut(ctx context.Context, req *wire.Request, res *wire.Response) (retErr error) {
 	actionID, outputID := fmt.Sprintf("%x", req.ActionID), fmt.Sprintf("%x", req.OutputID)
 	p.Puts.Add(1)
+	p.PutsInFlight.Add(1)
+	defer p.PutsInFlight.Add(-1)
 	defer func() {
 		if retErr != nil {
 			p.PutErrors.Add(1)
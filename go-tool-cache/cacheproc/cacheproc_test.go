@@ -0,0 +1,138 @@
+package cacheproc
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/wire"
+)
+
+// client is cmd/go's end of a Process being served.
+type client struct {
+	w    *io.PipeWriter
+	enc  *json.Encoder
+	dec  *json.Decoder
+	done chan error
+}
+
+func serve(t *testing.T, p *Process) *client {
+	t.Helper()
+	reqR, reqW := io.Pipe()
+	resR, resW := io.Pipe()
+	c := &client{w: reqW, enc: json.NewEncoder(reqW), dec: json.NewDecoder(resR), done: make(chan error, 1)}
+	go func() {
+		err := p.Serve(reqR, resW)
+		resW.Close()
+		c.done <- err
+	}()
+	var caps wire.Response
+	if err := c.dec.Decode(&caps); err != nil {
+		t.Fatalf("reading capabilities: %v", err)
+	}
+	return c
+}
+
+func (c *client) get(t *testing.T, id int64) {
+	t.Helper()
+	if err := c.enc.Encode(&wire.Request{ID: id, Command: wire.CmdGet, ActionID: []byte{byte(id)}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (c *client) close(t *testing.T) {
+	t.Helper()
+	c.w.Close()
+	if err := <-c.done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls cond until it's true, failing the test if that takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSharedLimits(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+	get := func(ctx context.Context, actionID string) (string, string, error) {
+		entered <- struct{}{}
+		<-release
+		return "", "", nil
+	}
+	limits := NewLimits(1, 0)
+	p1 := &Process{Get: get, Limits: limits}
+	p2 := &Process{Get: get, Limits: limits}
+	c1, c2 := serve(t, p1), serve(t, p2)
+
+	c1.get(t, 1)
+	<-entered
+	c2.get(t, 2)
+	waitFor(t, "the second get to wait", func() bool { return p2.GetsWaiting.Load() == 1 })
+	select {
+	case <-entered:
+		t.Fatal("second client's get ran while the first held the only slot")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := p1.GetsInFlight.Load() + p2.GetsInFlight.Load(); got != 1 {
+		t.Errorf("%d gets in flight, want 1", got)
+	}
+	if got := p2.MaxGetsWaiting.Load(); got != 1 {
+		t.Errorf("MaxGetsWaiting = %d, want 1", got)
+	}
+
+	close(release)
+	for _, c := range []*client{c1, c2} {
+		var res wire.Response
+		if err := c.dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Miss || res.Err != "" {
+			t.Errorf("got %+v, want a miss", res)
+		}
+		c.close(t)
+	}
+	if p1.GetsWaiting.Load() != 0 || p2.GetsWaiting.Load() != 0 || p1.GetsInFlight.Load() != 0 || p2.GetsInFlight.Load() != 0 {
+		t.Errorf("gauges not back to zero: waiting %d+%d, in flight %d+%d",
+			p1.GetsWaiting.Load(), p2.GetsWaiting.Load(), p1.GetsInFlight.Load(), p2.GetsInFlight.Load())
+	}
+	if p2.GetWaitNanos.Load() == 0 {
+		t.Error("GetWaitNanos not counted")
+	}
+}
+
+func TestUnsharedLimits(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 2)
+	get := func(ctx context.Context, actionID string) (string, string, error) {
+		entered <- struct{}{}
+		<-release
+		return "", "", nil
+	}
+	// each Process has its own limit of one
+	p1 := &Process{Get: get, MaxConcurrentGets: 1}
+	p2 := &Process{Get: get, MaxConcurrentGets: 1}
+	c1, c2 := serve(t, p1), serve(t, p2)
+	c1.get(t, 1)
+	c2.get(t, 2)
+	<-entered
+	<-entered
+	waitFor(t, "both gets in flight", func() bool { return p1.GetsInFlight.Load()+p2.GetsInFlight.Load() == 2 })
+	close(release)
+	for _, c := range []*client{c1, c2} {
+		var res wire.Response
+		if err := c.dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		c.close(t)
+	}
+}
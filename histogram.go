@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the latency histogram buckets
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// sizeBuckets are the upper bounds, in bytes, of the size histogram buckets
+var sizeBuckets = []float64{0, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+
+// histogram counts observations in buckets. The buckets are passed in, rather than kept, so that the zero value is
+// ready to use; use latencyHistogram or sizeHistogram rather than histogram directly.
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative; the last one is +Inf
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+func (h *histogram) observe(bounds []float64, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(bounds)+1)
+	}
+	i := len(bounds)
+	for j, b := range bounds {
+		if v <= b {
+			i = j
+			break
+		}
+	}
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.max = max(h.max, v)
+}
+
+// histogramSnapshot is a consistent copy of a histogram.
+type histogramSnapshot struct {
+	Bounds []float64
+	// Cumulative counts, Prometheus-style: Cumulative[i] is the number of observations <= Bounds[i]; the +Inf bucket
+	// is Count.
+	Cumulative []uint64
+	Count      uint64
+	Sum        float64
+	Max        float64
+}
+
+func (h *histogram) snapshot(bounds []float64) histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{
+		Bounds:     bounds,
+		Cumulative: make([]uint64, len(bounds)),
+		Count:      h.count,
+		Sum:        h.sum,
+		Max:        h.max,
+	}
+	var n uint64
+	for i := range bounds {
+		if h.counts != nil {
+			n += h.counts[i]
+		}
+		s.Cumulative[i] = n
+	}
+	return s
+}
+
+// Quantile estimates the q-quantile (0 <= q <= 1) by interpolating within the bucket it falls in. It's 0 if there
+// are no observations.
+func (s histogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := q * float64(s.Count)
+	var lower float64
+	var below uint64
+	for i, upper := range s.Bounds {
+		// empty buckets are skipped even at q=0, which would otherwise land in the first bucket, whatever is in it
+		if s.Cumulative[i] > 0 && float64(s.Cumulative[i]) >= rank {
+			inBucket := s.Cumulative[i] - below
+			v := lower + (upper-lower)*(rank-float64(below))/float64(inBucket)
+			return math.Min(v, s.Max)
+		}
+		lower, below = upper, s.Cumulative[i]
+	}
+	// it's in the +Inf bucket, which only has the max as an upper bound
+	return s.Max
+}
+
+// latencyHistogram is a histogram of operation latencies.
+type latencyHistogram struct {
+	h histogram
+}
+
+func (l *latencyHistogram) observe(d time.Duration) {
+	l.h.observe(latencyBuckets, d.Seconds())
+}
+
+func (l *latencyHistogram) snapshot() histogramSnapshot {
+	return l.h.snapshot(latencyBuckets)
+}
+
+// sizeHistogram is a histogram of object sizes.
+type sizeHistogram struct {
+	h histogram
+}
+
+func (s *sizeHistogram) observe(n int64) {
+	s.h.observe(sizeBuckets, float64(n))
+}
+
+func (s *sizeHistogram) snapshot() histogramSnapshot {
+	return s.h.snapshot(sizeBuckets)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestQuantile(t *testing.T) {
+	bounds := []float64{1, 2, 4}
+	hist := func(vs ...float64) histogramSnapshot {
+		var h histogram
+		for _, v := range vs {
+			h.observe(bounds, v)
+		}
+		return h.snapshot(bounds)
+	}
+	tests := []struct {
+		name string
+		s    histogramSnapshot
+		q    float64
+		want float64
+	}{
+		{"empty p0", hist(), 0, 0},
+		{"empty p50", hist(), 0.5, 0},
+		{"empty p100", hist(), 1, 0},
+		// one in (0,1], two in (1,2], one in (2,4]
+		{"p0", hist(0.5, 1.5, 1.5, 3), 0, 0},
+		{"p25", hist(0.5, 1.5, 1.5, 3), 0.25, 1},
+		{"p50", hist(0.5, 1.5, 1.5, 3), 0.5, 1.5},
+		{"p75", hist(0.5, 1.5, 1.5, 3), 0.75, 2},
+		// interpolates to the bucket's upper bound, 4, but nothing is above the max
+		{"p100", hist(0.5, 1.5, 1.5, 3), 1, 3},
+		// the first buckets are empty, so p0 is the lower bound of the first one that isn't
+		{"p0 past empty buckets", hist(3, 3), 0, 2},
+		{"p100 in the last bucket", hist(3, 4), 1, 4},
+		// the +Inf bucket has no upper bound but the max
+		{"p0 all over", hist(10, 20), 0, 20},
+		{"p50 over", hist(0.5, 10), 0.5, 1},
+		{"p99 over", hist(0.5, 10), 0.99, 10},
+		{"p100 over", hist(0.5, 10), 1, 10},
+	}
+	for _, tt := range tests {
+		if got := tt.s.Quantile(tt.q); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: Quantile(%v) = %v, want %v", tt.name, tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// diskInspection is what the disk cache has for an action.
+type diskInspection struct {
+	Found bool   `json:"found"`
+	Error string `json:"error,omitempty"`
+	// Entry is the index entry as stored
+	Entry          *indexEntry `json:"entry,omitempty"`
+	Time           time.Time   `json:"time,omitzero"`
+	AccessReported time.Time   `json:"accessReported,omitzero"`
+	// OutputFile is the output file, which may be compressed; it's empty if there isn't one
+	OutputFile     string      `json:"outputFile,omitempty"`
+	OutputFileSize int64       `json:"outputFileSize,omitempty"`
+	Compression    Compression `json:"compression,omitempty"`
+}
+
+// s3Inspection is what S3 has for an action, according to a HeadObject.
+type s3Inspection struct {
+	Key          string            `json:"key"`
+	Found        bool              `json:"found"`
+	Error        string            `json:"error,omitempty"`
+	OutputID     string            `json:"outputID,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	StoredSize   int64             `json:"storedSize,omitempty"`
+	Compression  string            `json:"compression,omitempty"`
+	ETag         string            `json:"etag,omitempty"`
+	Time         time.Time         `json:"time,omitzero"`
+	LastModified time.Time         `json:"lastModified,omitzero"`
+	StorageClass string            `json:"storageClass,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// inspection is what each tier has for an action, and how they differ.
+type inspection struct {
+	ActionID string         `json:"actionID"`
+	Disk     diskInspection `json:"disk"`
+	S3       s3Inspection   `json:"s3"`
+	// Disagreements are the ways the tiers differ, if the action is in both
+	Disagreements []string `json:"disagreements"`
+}
+
+// inspect reads the index entry of actionID, without touching it or its output.
+func (c *DiskCache) inspect(actionID string) diskInspection {
+	var d diskInspection
+	ij, err := os.ReadFile(c.actionFile(actionID))
+	if os.IsNotExist(err) {
+		return d
+	} else if err != nil {
+		d.Error = err.Error()
+		return d
+	}
+	d.Found = true
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		d.Error = fmt.Sprintf("bad index JSON: %v", err)
+		return d
+	}
+	d.Entry = &ie
+	d.Time = time.Unix(0, ie.TimeNanos)
+	d.AccessReported = c.accessReported(actionID)
+	if !validID(ie.OutputID) {
+		d.Error = fmt.Sprintf("bad outputID %q", ie.OutputID)
+		return d
+	}
+	for _, compression := range []Compression{CompressionNone, CompressionZstd, CompressionGzip} {
+		file := c.outputFile(ie.OutputID) + compression.Ext()
+		fi, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		d.OutputFile, d.OutputFileSize, d.Compression = file, fi.Size(), compression
+		break
+	}
+	if d.OutputFile == "" {
+		d.Error = "output file missing"
+	}
+	return d
+}
+
+// inspect heads the object for actionID.
+func (c *DiskAsyncS3Cache) inspect(ctx context.Context, actionID string) s3Inspection {
+	s := s3Inspection{Key: c.actionKey(actionID)}
+	out, err := c.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &c.bucketName,
+		Key:    &s.Key,
+	})
+	if isS3NotFoundError(err) {
+		return s
+	} else if err != nil {
+		s.Error = err.Error()
+		return s
+	}
+	s.Found = true
+	s.Metadata = out.Metadata
+	s.OutputID = out.Metadata[outputIDMetadataKey]
+	s.StoredSize = aws.ToInt64(out.ContentLength)
+	s.Size = s.StoredSize
+	s.ETag = aws.ToString(out.ETag)
+	s.LastModified = aws.ToTime(out.LastModified)
+	s.Time = objectTime(out.Metadata, s.LastModified)
+	s.StorageClass = string(out.StorageClass)
+	if s.StorageClass == "" {
+		// S3 leaves it out for the default
+		s.StorageClass = "STANDARD"
+	}
+	if s.OutputID == "" {
+		s.Error = "outputId not found in metadata"
+	}
+	if alg, ok := out.Metadata[compressionMetadataKey]; ok {
+		s.Compression = alg
+		if s.Size, err = strconv.ParseInt(out.Metadata[rawSizeMetadataKey], 10, 64); err != nil {
+			s.Error = fmt.Sprintf("bad raw size metadata: %v", err)
+		}
+	}
+	return s
+}
+
+// Inspect looks up actionID on disk and in S3, without counting it as a get, and compares what it finds.
+func (c *DiskAsyncS3Cache) Inspect(ctx context.Context, actionID string) *inspection {
+	in := &inspection{
+		ActionID:      actionID,
+		Disk:          c.diskCache.inspect(actionID),
+		S3:            c.inspect(ctx, actionID),
+		Disagreements: []string{},
+	}
+	ie := in.Disk.Entry
+	if ie == nil || !in.S3.Found {
+		return in
+	}
+	if ie.OutputID != in.S3.OutputID {
+		in.Disagreements = append(in.Disagreements, fmt.Sprintf("outputID: disk has %s, s3 has %s", ie.OutputID, in.S3.OutputID))
+	}
+	if ie.Size != in.S3.Size {
+		in.Disagreements = append(in.Disagreements, fmt.Sprintf("size: disk has %d, s3 has %d", ie.Size, in.S3.Size))
+	}
+	if ie.Origin == originRemote && ie.ETag != "" && ie.ETag != in.S3.ETag {
+		in.Disagreements = append(in.Disagreements, fmt.Sprintf("etag: disk was filled from %s, s3 now has %s", ie.ETag, in.S3.ETag))
+	}
+	return in
+}
+
+// dumpOutput writes the output of the action to w, from the disk cache if it's there, else from S3. It returns where
+// it came from.
+func (c *DiskAsyncS3Cache) dumpOutput(ctx context.Context, in *inspection, w io.Writer) (string, error) {
+	if in.Disk.OutputFile != "" && in.Disk.Error == "" {
+		f, err := os.Open(in.Disk.OutputFile)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		r, err := in.Disk.Compression.NewReader(f)
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+		_, err = io.Copy(w, r)
+		return in.Disk.OutputFile, err
+	}
+	if !in.S3.Found {
+		return "", errors.New("no output on disk or in s3")
+	}
+	out, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &c.bucketName,
+		Key:    &in.S3.Key,
+	})
+	if err != nil {
+		return "", err
+	}
+	obj, err := c.decodeObject(in.S3.Key, out)
+	if err != nil {
+		return "", err
+	}
+	defer obj.Body.Close()
+	_, err = io.Copy(w, obj.Body)
+	return fmt.Sprintf("s3://%s/%s", c.bucketName, in.S3.Key), err
+}
+
+func (in *inspection) write(w io.Writer) {
+	fmt.Fprintf(w, "action %s\n", in.ActionID)
+	d := in.Disk
+	switch {
+	case !d.Found && d.Error == "":
+		fmt.Fprintf(w, "disk: not found\n")
+	case d.Entry == nil:
+		fmt.Fprintf(w, "disk: %s\n", d.Error)
+	default:
+		fmt.Fprintf(w, "disk:\n")
+		fmt.Fprintf(w, "  outputID:        %s\n", d.Entry.OutputID)
+		fmt.Fprintf(w, "  size:            %d\n", d.Entry.Size)
+		fmt.Fprintf(w, "  time:            %s\n", d.Time.Format(time.RFC3339))
+		origin := d.Entry.Origin
+		if origin == "" {
+			origin = originLocal
+		}
+		if d.Entry.ETag != "" {
+			origin += ", etag " + d.Entry.ETag
+		}
+		fmt.Fprintf(w, "  origin:          %s\n", origin)
+		if !d.AccessReported.IsZero() {
+			fmt.Fprintf(w, "  access reported: %s\n", d.AccessReported.Format(time.RFC3339))
+		}
+		if d.OutputFile != "" {
+			fmt.Fprintf(w, "  output file:     %s (%d bytes, %s)\n", d.OutputFile, d.OutputFileSize, d.Compression)
+		}
+		if d.Error != "" {
+			fmt.Fprintf(w, "  error:           %s\n", d.Error)
+		}
+	}
+	s := in.S3
+	switch {
+	case !s.Found && s.Error == "":
+		fmt.Fprintf(w, "s3: %s not found\n", s.Key)
+	case !s.Found:
+		fmt.Fprintf(w, "s3: %s: %s\n", s.Key, s.Error)
+	default:
+		fmt.Fprintf(w, "s3: %s\n", s.Key)
+		fmt.Fprintf(w, "  outputID:        %s\n", s.OutputID)
+		if s.Compression != "" {
+			fmt.Fprintf(w, "  size:            %d (%d stored, %s)\n", s.Size, s.StoredSize, s.Compression)
+		} else {
+			fmt.Fprintf(w, "  size:            %d\n", s.Size)
+		}
+		fmt.Fprintf(w, "  etag:            %s\n", s.ETag)
+		fmt.Fprintf(w, "  time:            %s\n", s.Time.Format(time.RFC3339))
+		fmt.Fprintf(w, "  last modified:   %s\n", s.LastModified.Format(time.RFC3339))
+		fmt.Fprintf(w, "  storage class:   %s\n", s.StorageClass)
+		if s.Error != "" {
+			fmt.Fprintf(w, "  error:           %s\n", s.Error)
+		}
+	}
+	if d.Entry != nil && s.Found {
+		if len(in.Disagreements) == 0 {
+			fmt.Fprintf(w, "disk and s3 agree\n")
+		}
+		for _, msg := range in.Disagreements {
+			fmt.Fprintf(w, "disagree on %s\n", msg)
+		}
+	}
+}
+
+// runInspect implements the inspect subcommand, which shows what the disk cache and S3 have for one action.
+func runInspect(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	dump := fs.String("o", "", "write the action's output to this file (from disk if it's there, else from s3)")
+	asJSON := fs.Bool("json", false, "write what was found as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: inspect [flags] <actionID>\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("inspect: want one actionID")
+	}
+	actionID := fs.Arg(0)
+	if !validID(actionID) {
+		return fmt.Errorf("inspect: %q is not an actionID", actionID)
+	}
+
+	in := cacher.Inspect(ctx, actionID)
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(in); err != nil {
+			return err
+		}
+	} else {
+		in.write(os.Stdout)
+	}
+	if *dump == "" {
+		return nil
+	}
+	f, err := os.Create(*dump)
+	if err != nil {
+		return err
+	}
+	from, err := cacher.dumpOutput(ctx, in, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("dumping output: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote output from %s to %s\n", from, *dump)
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// accessPath is where access markers live under the s3 prefix. An access marker lists the actionIDs a run hit, one
+// per line like a manifest; its LastModified is when they were (last) used. gc uses them to keep entries that are
+// still read, however old they are.
+const accessPath = "_access"
+
+// markerKey is the key of a new marker under dir (accessPath or importPath).
+func (c *DiskAsyncS3Cache) markerKey(dir string, t time.Time) string {
+	// the random suffix keeps runs that finish in the same second apart
+	return fmt.Sprintf("%s/%s/%s-%08x", c.s3Prefix, dir, t.UTC().Format("20060102T150405Z"), rand.Uint32())
+}
+
+// noteAccess records that actionID was hit, for the access marker, unless a hit on it was reported less than
+// AccessInterval ago (by any run sharing the disk cache).
+func (c *DiskAsyncS3Cache) noteAccess(actionID string) {
+	if !c.RecordAccess {
+		return
+	}
+	if c.AccessInterval > 0 {
+		if time.Since(c.diskCache.accessReported(actionID)) < c.AccessInterval {
+			return
+		}
+	}
+	c.accessed.Store(actionID, struct{}{})
+}
+
+// putAccessMarker puts an access marker with the actionIDs hit in this run, if there are any, then records in the
+// disk cache that they were reported.
+func (c *DiskAsyncS3Cache) putAccessMarker(ctx context.Context) error {
+	var actionIDs []string
+	c.accessed.Range(func(k, _ any) bool {
+		actionIDs = append(actionIDs, k.(string))
+		return true
+	})
+	if len(actionIDs) == 0 {
+		return nil
+	}
+	now := time.Now()
+	key := c.markerKey(accessPath, now)
+	c.log.Debug("put access marker", "key", key, "n", len(actionIDs))
+	if err := c.putActionIDs(ctx, key, actionIDs); err != nil {
+		return err
+	}
+	for _, actionID := range actionIDs {
+		if err := c.diskCache.setAccessReported(actionID, now); err != nil {
+			// the worst that happens is that we report it again next time
+			c.log.Warn("recording access reported", "actionID", actionID, "err", err)
+		}
+	}
+	return nil
+}
+
+// lastAccesses reads all the access markers, returning when each actionID in them was last used, and the markers
+// themselves.
+func (c *DiskAsyncS3Cache) lastAccesses(ctx context.Context, parallel int) (map[string]time.Time, []remoteObject, error) {
+	return c.readMarkers(ctx, accessPath, parallel)
+}
+
+// readMarkers reads all the markers under dir, returning the LastModified of the latest marker each actionID is in,
+// and the markers themselves.
+func (c *DiskAsyncS3Cache) readMarkers(ctx context.Context, dir string, parallel int) (map[string]time.Time, []remoteObject, error) {
+	var markers []remoteObject
+	err := c.listObjects(ctx, fmt.Sprintf("%s/%s/", c.s3Prefix, dir), func(o remoteObject) error {
+		markers = append(markers, o)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	last := make(map[string]time.Time)
+	var mu sync.Mutex
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(parallel, 1))
+	for _, m := range markers {
+		g.Go(func() error {
+			actionIDs, err := c.getActionIDs(ctx, m.Key)
+			if err != nil {
+				return fmt.Errorf("reading marker %s: %w", m.Key, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, actionID := range actionIDs {
+				if m.LastModified.After(last[actionID]) {
+					last[actionID] = m.LastModified
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, nil, err
+	}
+	return last, markers, nil
+}
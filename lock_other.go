@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockFile is a no-op where we don't have flock: processes sharing a cache dir may do redundant work, but atomic
+// renames keep the files themselves intact.
+func lockFile(path string) (unlock func(), _ error) {
+	return func() {}, nil
+}
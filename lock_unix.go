@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on path (creating it if need be), blocking until it gets it. unlock removes the
+// file, so lock files don't pile up, and releases the lock.
+func lockFile(path string) (unlock func(), _ error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err := flock(f, syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, err
+		}
+		// If the previous holder removed the file after we opened it, we have a lock on a file nobody else can see;
+		// start over with a fresh one.
+		fi, err := f.Stat()
+		pi, pErr := os.Stat(path)
+		if err == nil && pErr == nil && os.SameFile(fi, pi) {
+			return func() {
+				_ = os.Remove(path)
+				_ = flock(f, syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+		f.Close()
+	}
+}
+
+func flock(f *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
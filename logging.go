@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/aws/smithy-go/logging"
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/cacheproc"
+)
+
+// componentKey is the attribute naming the part of the program that logged a record, e.g. "disk" or "aws"
+const componentKey = "component"
+
+// newLogHandler makes the handler for -log-format: text (our own), json or logfmt (slog's).
+func newLogHandler(format string, w io.Writer, level slog.Level) (slog.Handler, error) {
+	var h slog.Handler
+	switch format {
+	case "text":
+		h = &logHandler{Out: w, Level: level}
+	case "json":
+		h = slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})
+	case "logfmt":
+		h = slog.NewTextHandler(w, &slog.HandlerOptions{Level: level})
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want text, json or logfmt)", format)
+	}
+	return requestIDHandler{h}, nil
+}
+
+// requestIDHandler adds the ID of the cacheproc request, if any, to records logged with its context.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := cacheproc.RequestID(ctx); ok {
+		r.AddAttrs(slog.Int64("requestID", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// awsLogger implements AWS's logging.Logger (and ContextLogger, so request IDs come along) on top of slog.
+type awsLogger struct {
+	ctx context.Context
+	log *slog.Logger
+}
+
+func newAWSLogger() awsLogger {
+	return awsLogger{ctx: context.Background(), log: slog.Default().With(componentKey, "aws")}
+}
+
+func (a awsLogger) Logf(cls logging.Classification, format string, args ...interface{}) {
+	var l slog.Level
+	switch cls {
+	case logging.Debug:
+		l = slog.LevelDebug
+	case logging.Warn:
+		l = slog.LevelWarn
+	default:
+		l = slog.LevelDebug
+	}
+	a.log.Log(a.ctx, l, fmt.Sprintf(format, args...))
+}
+
+func (a awsLogger) WithContext(ctx context.Context) logging.Logger {
+	return awsLogger{ctx: ctx, log: a.log}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -14,8 +15,8 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/smithy-go/logging"
 	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/cacheproc"
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/wire"
 
 	"github.com/aws/aws-sdk-go-v2/config"
 )
@@ -26,14 +27,38 @@ var userCacheDir, _ = os.UserCacheDir()
 var defaultLocalCacheDir = filepath.Join(userCacheDir, "go-cacher")
 
 var (
-	flagVerbose       = flag.Int("v", 0, "logging verbosity; 0=error, 1=warn, 2=info, 3=debug, 4=trace")
-	flagS3Prefix      = flag.String("s3-prefix", defaultS3Prefix, "s3 prefix")
-	flagLocalCacheDir = flag.String("local-cache-dir", defaultLocalCacheDir, "local cache directory")
-	bucket            string
-	flagQueueLen      = flag.Int("queue-len", 0, "length of the queue for async s3 cache (0=synchronous)")
-	flagWorkers       = flag.Int("workers", 1, "number of workers for async s3 cache (1=synchronous)")
-	flagMetCSV        = flag.String("metrics-csv", "", "write s3 Get/Put metrics to a CSV file (empty=disabled)")
-	flagBucket        = flag.String("bucket", "", "s3 bucket to use (empty=use $GOCACHEPROGS3_BUCKET)")
+	flagVerbose         = flag.Int("v", 0, "logging verbosity; 0=error, 1=warn, 2=info, 3=debug, 4=trace")
+	flagLogFormat       = flag.String("log-format", "text", "log format: text, json or logfmt")
+	flagLogFile         = flag.String("log-file", "", "append logs to this file (empty=stderr)")
+	flagS3Prefix        = flag.String("s3-prefix", defaultS3Prefix, "s3 prefix")
+	flagLocalCacheDir   = flag.String("local-cache-dir", defaultLocalCacheDir, "local cache directory")
+	bucket              string
+	flagQueueLen        = flag.Int("queue-len", 0, "length of the queue for async s3 cache (0=synchronous)")
+	flagWorkers         = flag.Int("workers", 1, "number of workers for async s3 cache (1=synchronous)")
+	flagMaxGets         = flag.Int("max-concurrent-gets", 0, "max number of gets from cmd/go to handle at once (0=unlimited)")
+	flagMaxPuts         = flag.Int("max-concurrent-puts", 0, "max number of puts from cmd/go to handle (and hold in memory) at once (0=unlimited)")
+	flagMetCSV          = flag.String("metrics-csv", "", "write s3 Get/Put metrics to a CSV file at exit (empty=disabled)")
+	flagMetCSVInterval  = flag.Duration("metrics-csv-interval", 0, "instead, append rows of both tiers' metrics to -metrics-csv at this interval and at exit (0=one s3 row at exit)")
+	flagStatsJSON       = flag.String("stats-json", "", "write a JSON report of the cache stats, config and toolchain to this file at exit (empty=disabled)")
+	flagMetricsAddr     = flag.String("metrics-addr", "", "serve Prometheus metrics on http://<addr>/metrics, e.g. :9100 (empty=disabled)")
+	flagAccessLog       = flag.String("access-log", "", "append a JSON line per request from cmd/go to this file (empty=disabled)")
+	flagOTLPEndpoint    = flag.String("otlp-endpoint", "", "export traces over OTLP/HTTP to this URL, e.g. http://localhost:4318 (empty=disabled)")
+	flagTraceFile       = flag.String("trace-file", "", "write traces as JSON to this file (empty=disabled)")
+	flagBucket          = flag.String("bucket", "", "s3 bucket to use (empty=use $GOCACHEPROGS3_BUCKET)")
+	flagCompression     = flag.String("s3-compression", "none", "compression for objects put to s3: none, gzip or zstd")
+	flagCompressMin     = flag.Int64("s3-compression-min-size", 4096, "objects smaller than this many bytes are put to s3 uncompressed")
+	flagSkipExisting    = flag.Bool("s3-skip-existing", false, "check whether an action is already in s3 (with a HeadObject) before uploading it, not just whether it's known to be")
+	flagDiskCompress    = flag.String("disk-compression", "none", "compression for cold local cache outputs: none, gzip or zstd")
+	flagCompressAfter   = flag.Duration("disk-compress-after", 24*time.Hour, "local cache outputs unused for this long are compressed in the background (requires -disk-compression)")
+	flagBackfill        = flag.Bool("backfill", false, "in the background, upload local cache entries that are missing from s3 (like the sync subcommand)")
+	flagBackfillRate    = flag.Float64("backfill-rate", 10, "max entries checked in s3 (and uploaded) per second for -backfill (0=unlimited)")
+	flagManifest        = flag.String("manifest", "", "name of a manifest of the actions gotten by this build to put to s3, e.g. <repo>/<branch> (empty=disabled)")
+	flagPrefetch        = flag.Bool("prefetch", false, "in the background, warm the local cache from the previous -manifest (like the warm subcommand)")
+	flagPrefetchWorkers = flag.Int("prefetch-workers", 8, "number of parallel downloads for -prefetch, -coaccess and warm")
+	flagCoaccess        = flag.Bool("coaccess", false, "learn which actions are fetched from s3 together, and prefetch the rest of a group on its first hit")
+	flagRecordAccess    = flag.Bool("record-access", false, "on exit, put an access marker to s3 listing the actions hit, so that gc keeps them")
+	flagAccessInterval  = flag.Duration("record-access-interval", 24*time.Hour, "with -record-access, report a hit on an action at most this often (0=every run)")
+	flagDaemonSocket    = flag.String("daemon-socket", "", "unix socket of a shared daemon (see the serve subcommand) to relay to, falling back to running in-process if there is none (empty=disabled)")
 )
 
 // logHandler implements slog.Handler to print logs nicely
@@ -51,15 +76,29 @@ func (h *logHandler) Enabled(_ context.Context, l slog.Level) bool {
 
 func (h *logHandler) Handle(_ context.Context, r slog.Record) error {
 	s := r.Level.String()[:1]
-	if len(h.groups) > 0 {
-		s += " " + strings.Join(h.groups, ".") + ":"
+	var attrs []slog.Attr
+	var component string
+	collect := func(a slog.Attr) bool {
+		// the component goes up front, like a group
+		if a.Key == componentKey {
+			component = a.Value.String()
+		} else {
+			attrs = append(attrs, a)
+		}
+		return true
+	}
+	for _, a := range h.attrs {
+		collect(a)
+	}
+	r.Attrs(collect)
+	prefix := h.groups
+	if component != "" {
+		prefix = append([]string{component}, h.groups...)
+	}
+	if len(prefix) > 0 {
+		s += " " + strings.Join(prefix, ".") + ":"
 	}
 	s += " " + r.Message
-	attrs := h.attrs
-	r.Attrs(func(a slog.Attr) bool {
-		attrs = append(attrs, a)
-		return true
-	})
 	for i, a := range attrs {
 		if i == 0 {
 			s += " {"
@@ -97,54 +136,189 @@ func (h *logHandler) WithGroup(name string) slog.Handler {
 	}
 }
 
-// Logf allows us to also implement AWS's logging.Logger
-func (h *logHandler) Logf(cls logging.Classification, format string, args ...interface{}) {
-	var l slog.Level
-	switch cls {
-	case logging.Debug:
-		l = slog.LevelDebug
-	case logging.Warn:
-		l = slog.LevelWarn
-	default:
-		l = slog.LevelDebug
+var levelTrace = slog.Level(slog.LevelDebug - 4)
+
+// subcommands are run instead of the cacheprog when named as the first argument
+var subcommands = []struct{ name, desc string }{
+	{"sync", "upload local cache entries that are missing from s3"},
+	{"warm", "fill the local cache with the entries in a manifest"},
+	{"serve", "run a daemon on -daemon-socket that GOCACHEPROGs with the same -daemon-socket relay to"},
+	{"stats", "summarize the objects in s3: counts, sizes, ages and the largest"},
+	{"gc", "delete entries from s3 that are idle too long or over a size budget"},
+	{"verify", "check the disk cache and a sample of s3 for corrupt entries"},
+	{"inspect", "show what the disk cache and s3 have for one action, and whether they agree"},
+	{"export", "pack entries from the disk cache or s3 into an archive"},
+	{"import", "unpack an archive from export into the disk cache or s3"},
+	{"explain", "compare the access logs or manifests of two runs to see why one missed more"},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+	fmt.Fprintf(w, "usage: %s [flags] [subcommand [subcommand flags]]\n\n", os.Args[0])
+	fmt.Fprintf(w, "Without a subcommand, runs as a GOCACHEPROG.\n\nsubcommands:\n")
+	for _, sc := range subcommands {
+		fmt.Fprintf(w, "  %-10s %s\n", sc.name, sc.desc)
 	}
+	fmt.Fprintf(w, "\nflags:\n")
+	flag.PrintDefaults()
+}
 
-	h.Handle(context.Background(), slog.Record{
-		Level:   l,
-		Message: fmt.Sprintf(format, args...),
-	})
+// setBackgroundOptions sets the options for background work, which only make sense for a cache that serves cmd/go.
+func setBackgroundOptions(cacher *DiskAsyncS3Cache) {
+	cacher.BackgroundBackfill = *flagBackfill
+	cacher.BackfillRate = *flagBackfillRate
+	cacher.Prefetch = *flagPrefetch
+	cacher.PrefetchWorkers = *flagPrefetchWorkers
+	cacher.Coaccess = *flagCoaccess
+	cacher.RecordAccess = *flagRecordAccess
+	cacher.AccessInterval = *flagAccessInterval
 }
 
-var levelTrace = slog.Level(slog.LevelDebug - 4)
+// newProcess makes a cacheproc.Process serving cmd/go from cacher.
+func newProcess(cacher *DiskAsyncS3Cache) *cacheproc.Process {
+	proc := &cacheproc.Process{
+		Get:               cacher.Get,
+		Put:               cacher.Put,
+		Close:             cacher.Close,
+		MaxConcurrentGets: *flagMaxGets,
+		MaxConcurrentPuts: *flagMaxPuts,
+	}
+	var hooks []func(context.Context, *wire.Request) (context.Context, func(*wire.Response, error))
+	if tracingEnabled() {
+		hooks = append(hooks, startRequestSpan)
+	}
+	if accessLogger != nil {
+		hooks = append(hooks, accessLogger.startRequest)
+	}
+	proc.StartRequest = chainStartRequest(hooks...)
+	return proc
+}
+
+// newStatsReport builds the -stats-json report for a run that started at start and ended with err.
+func newStatsReport(start time.Time, diskCacher *DiskCache, cacher *DiskAsyncS3Cache, procs *processStats, err error) *statsReport {
+	mode := flag.Arg(0)
+	if mode == "" {
+		mode = "cacheprog"
+	}
+	end := time.Now()
+	r := &statsReport{
+		Mode:        mode,
+		Start:       start,
+		End:         end,
+		WallSeconds: end.Sub(start).Seconds(),
+		Config: configReport{
+			Bucket:             bucket,
+			Prefix:             *flagS3Prefix,
+			LocalCacheDir:      *flagLocalCacheDir,
+			Compression:        cacher.Compression.String(),
+			CompressionMinSize: cacher.CompressionMinSize,
+			DiskCompression:    diskCacher.Compression.String(),
+			SkipExisting:       cacher.SkipExisting,
+			Manifest:           cacher.Manifest,
+			Prefetch:           cacher.Prefetch,
+			Coaccess:           cacher.Coaccess,
+			Backfill:           cacher.BackgroundBackfill,
+			BackfillRate:       cacher.BackfillRate,
+			MaxConcurrentGets:  *flagMaxGets,
+			MaxConcurrentPuts:  *flagMaxPuts,
+		},
+		Toolchain: newToolchainReport(),
+		CacheProc: procs.snapshot(),
+		Queue:     cacher.queueReport(),
+		Tiers: map[string]countsReport{
+			"disk": diskCacher.Counts.report(),
+			"s3":   cacher.Counts.report(),
+		},
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+func tracingEnabled() bool {
+	return *flagOTLPEndpoint != "" || *flagTraceFile != ""
+}
+
+func runCacheProg(ctx context.Context, cacher *DiskAsyncS3Cache, procs *processStats) error {
+	err := cacher.Start(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start cache: %w", err)
+	}
+	proc := newProcess(cacher)
+	procs.start(proc)
+	defer procs.done(proc)
+	return proc.Run()
+}
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
-	bucket = *flagBucket
-	if bucket == "" {
-		bucket = os.Getenv("GOCACHEPROGS3_BUCKET")
-		if bucket == "" {
-			log.Fatal("neither --bucket nor GOCACHEPROGS3_BUCKET environment variable set")
+	logLevel := slog.Level(*flagVerbose*-4 + 8)
+	var logOut io.Writer = os.Stderr
+	if *flagLogFile != "" {
+		f, err := os.OpenFile(*flagLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatal("failed to open log file: ", err)
 		}
+		defer f.Close()
+		logOut = f
 	}
-	logLevel := slog.Level(*flagVerbose*-4 + 8)
-	h := &logHandler{
-		Level: logLevel,
-		Out:   os.Stderr,
+	h, err := newLogHandler(*flagLogFormat, logOut, logLevel)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	slog.SetDefault(slog.New(h))
 
 	slog.Debug(fmt.Sprintf("Log level: %s", logLevel))
+	// run's deferred calls (e.g. flushing traces) must be done before we exit
+	if err := run(logLevel); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run is main after logging is set up.
+func run(logLevel slog.Level) error {
+	if flag.Arg(0) == "" && *flagDaemonSocket != "" {
+		// a client doesn't need any of the setup below; the daemon has done it
+		relayed, err := relayToDaemon(*flagDaemonSocket)
+		if err != nil || relayed {
+			return err
+		}
+	}
+	if flag.Arg(0) == "explain" {
+		// it only reads local files, so it needs none of the setup below
+		return runExplain(flag.Args()[1:])
+	}
+	bucket = *flagBucket
+	if bucket == "" {
+		bucket = os.Getenv("GOCACHEPROGS3_BUCKET")
+		if bucket == "" {
+			return errors.New("neither --bucket nor GOCACHEPROGS3_BUCKET environment variable set")
+		}
+	}
+	compression, err := parseCompression(*flagCompression)
+	if err != nil {
+		return err
+	}
+	diskCompression, err := parseCompression(*flagDiskCompress)
+	if err != nil {
+		return err
+	}
 	slog.Debug("starting cache")
 	var clientLogMode aws.ClientLogMode
 	if logLevel <= levelTrace {
 		clientLogMode = aws.LogRetries | aws.LogRequest
 	}
-	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithClientLogMode(clientLogMode), config.WithLogger(h))
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(), config.WithClientLogMode(clientLogMode), config.WithLogger(newAWSLogger()))
 	if err != nil {
-		log.Fatal("S3 cache disabled; failed to load AWS config: ", err)
+		return fmt.Errorf("S3 cache disabled; failed to load AWS config: %w", err)
 	}
 	diskCacher := NewDiskCache(*flagLocalCacheDir)
+	diskCacher.Compression = diskCompression
+	diskCacher.CompressAfter = *flagCompressAfter
 	cacher := NewDiskAsyncS3Cache(
 		diskCacher,
 		s3.NewFromConfig(awsConfig),
@@ -153,36 +327,89 @@ func main() {
 		*flagQueueLen,
 		*flagWorkers,
 	)
+	cacher.Compression = compression
+	cacher.CompressionMinSize = *flagCompressMin
+	cacher.SkipExisting = *flagSkipExisting
+	cacher.Manifest = *flagManifest
+	if tracingEnabled() {
+		shutdownTracing, err := setupTracing(context.Background(), *flagOTLPEndpoint, *flagTraceFile)
+		if err != nil {
+			return fmt.Errorf("failed to set up tracing: %w", err)
+		}
+		defer func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				slog.Error(fmt.Sprintf("failed to flush traces: %v", err))
+			}
+		}()
+	}
+	if *flagAccessLog != "" {
+		accessLogger, err = openAccessLog(*flagAccessLog)
+		if err != nil {
+			return fmt.Errorf("failed to open access log: %w", err)
+		}
+		defer accessLogger.Close()
+	}
+	if *flagMetricsAddr != "" {
+		serveMetrics(*flagMetricsAddr, diskCacher, cacher)
+	}
 	// TODO: not too sure we need this context
 	startCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	start := time.Now()
-	err = cacher.Start(startCtx)
-	if err != nil {
-		log.Fatalf("failed to start cache: %v", err)
+	var procs processStats
+	var metCSV *metricsCSV
+	if *flagMetCSV != "" {
+		metCSV, err = startMetricsCSV(*flagMetCSV, *flagMetCSVInterval, diskCacher, cacher, &procs)
+		if err != nil {
+			slog.Error(fmt.Sprintf("failed to create metrics file: %v", err))
+		}
 	}
-	proc := cacheproc.Process{
-		Get:   cacher.Get,
-		Put:   cacher.Put,
-		Close: cacher.Close,
+	switch cmd := flag.Arg(0); cmd {
+	case "":
+		setBackgroundOptions(cacher)
+		err = runCacheProg(startCtx, cacher, &procs)
+	case "serve":
+		setBackgroundOptions(cacher)
+		err = runServe(startCtx, cacher, flag.Args()[1:], &procs)
+	case "sync":
+		err = runSync(startCtx, cacher, flag.Args()[1:])
+	case "warm":
+		err = runWarm(startCtx, cacher, flag.Args()[1:])
+	case "stats":
+		err = runStats(startCtx, cacher, flag.Args()[1:])
+	case "gc":
+		err = runGC(startCtx, cacher, flag.Args()[1:])
+	case "verify":
+		err = runVerify(startCtx, cacher, flag.Args()[1:])
+	case "inspect":
+		err = runInspect(startCtx, cacher, flag.Args()[1:])
+	case "export":
+		err = runExport(startCtx, cacher, flag.Args()[1:])
+	case "import":
+		err = runImport(startCtx, cacher, flag.Args()[1:])
+	default:
+		flag.Usage()
+		err = fmt.Errorf("unknown subcommand %q", cmd)
 	}
-	if err := proc.Run(); err != nil {
-		slog.Error(err.Error())
-		os.Exit(1)
+	if metCSV != nil {
+		if err := metCSV.Close(); err != nil {
+			slog.Error(fmt.Sprintf("failed to write metrics file: %v", err))
+		}
+	}
+	if *flagStatsJSON != "" {
+		r := newStatsReport(start, diskCacher, cacher, &procs, err)
+		if err := writeStatsReport(*flagStatsJSON, r); err != nil {
+			slog.Error(fmt.Sprintf("failed to write stats report: %v", err))
+		}
+	}
+	if err != nil {
+		return err
 	}
 	if logLevel <= slog.LevelInfo {
 		fmt.Fprintln(os.Stderr, "disk stats: \n"+diskCacher.Counts.Summary())
 		fmt.Fprintln(os.Stderr, "s3 stats: \n"+cacher.Counts.Summary())
 		fmt.Fprintln(os.Stderr, "total time: ", time.Since(start).Round(time.Second))
 	}
-	if *flagMetCSV != "" {
-		f, err := os.Create(*flagMetCSV)
-		if err != nil {
-			slog.Error(fmt.Sprintf("failed to create metrics file: %v", err))
-		} else {
-			defer f.Close()
-			cacher.Counts.CSV(f, true)
-		}
-	}
+	return nil
 }
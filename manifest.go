@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// manifestsPath is where manifests live under the s3 prefix; the leading _ keeps it apart from the actionIDs
+const manifestsPath = "_manifests"
+
+// A manifest is the list of actionIDs that a build got, one per line. They're stored in s3://<bucketName>/<s3Prefix>/_manifests/<name>,
+// where the name is up to the user, but something like <repo>/<branch> makes sense.
+func (c *DiskAsyncS3Cache) manifestKey(name string) string {
+	return fmt.Sprintf("%s/%s/%s", c.s3Prefix, manifestsPath, name)
+}
+
+// putManifest puts the manifest of the actionIDs gotten so far, if there are any.
+func (c *DiskAsyncS3Cache) putManifest(ctx context.Context) error {
+	var actionIDs []string
+	c.requested.Range(func(k, _ any) bool {
+		actionIDs = append(actionIDs, k.(string))
+		return true
+	})
+	if len(actionIDs) == 0 {
+		return nil
+	}
+	key := c.manifestKey(c.Manifest)
+	c.log.Debug("put manifest", "key", key, "n", len(actionIDs))
+	return c.putActionIDs(ctx, key, actionIDs)
+}
+
+// putActionIDs puts actionIDs to key, sorted and one per line, like a manifest.
+func (c *DiskAsyncS3Cache) putActionIDs(ctx context.Context, key string, actionIDs []string) error {
+	slices.Sort(actionIDs)
+	body := []byte(strings.Join(actionIDs, "\n") + "\n")
+	size := int64(len(body))
+	_, err := c.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        &c.bucketName,
+		Key:           &key,
+		Body:          bytes.NewReader(body),
+		ContentLength: &size,
+	})
+	return err
+}
+
+// getManifest gets the actionIDs in the named manifest. It returns nil if there's no such manifest.
+func (c *DiskAsyncS3Cache) getManifest(ctx context.Context, name string) ([]string, error) {
+	return c.getActionIDs(ctx, c.manifestKey(name))
+}
+
+// getActionIDs gets actionIDs put by putActionIDs. It returns nil if there's no such object.
+func (c *DiskAsyncS3Cache) getActionIDs(ctx context.Context, key string) ([]string, error) {
+	out, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &c.bucketName,
+		Key:    &key,
+	})
+	if isS3NotFoundError(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return readActionIDs(out.Body)
+}
+
+// readActionIDs reads a manifest: one actionID per line, ignoring blank lines.
+func readActionIDs(r io.Reader) ([]string, error) {
+	var actionIDs []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if line := strings.TrimSpace(sc.Text()); line != "" {
+			actionIDs = append(actionIDs, line)
+		}
+	}
+	return actionIDs, sc.Err()
+}
+
+// WarmResult counts what a warm-up did.
+type WarmResult struct {
+	Requested int
+	Local     int
+	Fetched   int
+	Missing   int
+	Errors    int
+}
+
+// WarmFromManifest gets the named manifest and warms the disk cache with it.
+func (c *DiskAsyncS3Cache) WarmFromManifest(ctx context.Context, name string, nWorkers int) (WarmResult, error) {
+	actionIDs, err := c.getManifest(ctx, name)
+	if err != nil {
+		return WarmResult{}, fmt.Errorf("getting manifest %q: %w", name, err)
+	}
+	if actionIDs == nil {
+		c.log.Info("no manifest to warm from", "manifest", name)
+	}
+	return c.Warm(ctx, actionIDs, nWorkers)
+}
+
+// Warm fills the disk cache from S3 with actionIDs using nWorkers in parallel, so that later Gets are local hits.
+// Actions that are already on disk are left alone.
+func (c *DiskAsyncS3Cache) Warm(ctx context.Context, actionIDs []string, nWorkers int) (WarmResult, error) {
+	var mu sync.Mutex // guards res
+	res := WarmResult{Requested: len(actionIDs)}
+	ids := make(chan string)
+	var wg sync.WaitGroup
+	for range max(nWorkers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for actionID := range ids {
+				var local, fetched, errored bool
+				if _, ok := c.diskCache.entry(actionID); ok {
+					local = true
+				} else if outputID, _, err := c.prefetchFill(ctx, actionID); err != nil {
+					c.log.Debug("warm", "actionID", actionID, "err", err)
+					errored = true
+				} else {
+					fetched = outputID != ""
+				}
+				mu.Lock()
+				switch {
+				case local:
+					res.Local++
+				case errored:
+					res.Errors++
+				case fetched:
+					res.Fetched++
+				default:
+					res.Missing++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	var err error
+feed:
+	for _, actionID := range actionIDs {
+		select {
+		case ids <- actionID:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+	return res, err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// metricsServer serves Prometheus metrics for the cache tiers on /metrics, in the text exposition format.
+// It's simple enough that it isn't worth pulling in the Prometheus client library.
+type metricsServer struct {
+	disk *DiskCache
+	s3   *DiskAsyncS3Cache
+
+	// the disk cache size takes a directory walk, so it's cached
+	sizeMu     sync.Mutex
+	sizeAt     time.Time
+	diskFiles  int64
+	diskBytes  int64
+	sizeMaxAge time.Duration
+}
+
+// serveMetrics starts serving metrics on addr in the background.
+func serveMetrics(addr string, disk *DiskCache, s3 *DiskAsyncS3Cache) {
+	m := &metricsServer{disk: disk, s3: s3, sizeMaxAge: 30 * time.Second}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		slog.Info("serving metrics", "addr", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			slog.Error("serving metrics", "addr", addr, "err", err)
+		}
+	}()
+}
+
+// counterFamilies are the Counts that are exported per tier, as counters.
+var counterFamilies = []struct {
+	name, help string
+	value      func(*Counts) int64
+}{
+	{"gocacheprog_gets_total", "Gets.", func(c *Counts) int64 { return c.gets.Load() }},
+	{"gocacheprog_hits_total", "Gets that hit.", func(c *Counts) int64 { return c.hits.Load() }},
+	{"gocacheprog_misses_total", "Gets that missed.", func(c *Counts) int64 { return c.misses.Load() }},
+	{"gocacheprog_get_errors_total", "Gets that failed.", func(c *Counts) int64 { return c.getErrors.Load() }},
+	{"gocacheprog_coalesced_total", "Gets coalesced into another in-flight get.", func(c *Counts) int64 { return c.coalesced.Load() }},
+	{"gocacheprog_puts_total", "Puts.", func(c *Counts) int64 { return c.puts.Load() }},
+	{"gocacheprog_put_errors_total", "Puts that failed.", func(c *Counts) int64 { return c.putErrors.Load() }},
+	{"gocacheprog_deduped_total", "Puts of outputs we already had.", func(c *Counts) int64 { return c.deduped.Load() }},
+	{"gocacheprog_skipped_total", "Uploads skipped because the action was already in s3.", func(c *Counts) int64 { return c.skipped.Load() }},
+	{"gocacheprog_get_bytes_total", "Bytes gotten, as transferred.", func(c *Counts) int64 { return c.totalGetBytes.Load() }},
+	{"gocacheprog_get_raw_bytes_total", "Bytes gotten, uncompressed.", func(c *Counts) int64 { return c.totalGetRawBytes.Load() }},
+	{"gocacheprog_put_bytes_total", "Bytes put, as transferred.", func(c *Counts) int64 { return c.totalPutBytes.Load() }},
+	{"gocacheprog_put_raw_bytes_total", "Bytes put, uncompressed.", func(c *Counts) int64 { return c.totalPutRawBytes.Load() }},
+}
+
+func (m *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	tiers := []struct {
+		name   string
+		counts *Counts
+	}{
+		{"disk", &m.disk.Counts},
+		{"s3", &m.s3.Counts},
+	}
+	for _, f := range counterFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", f.name, f.help, f.name)
+		for _, t := range tiers {
+			fmt.Fprintf(w, "%s{tier=%q} %d\n", f.name, t.name, f.value(t.counts))
+		}
+	}
+	for _, f := range histogramFamilies {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", f.name, f.help, f.name)
+		for _, t := range tiers {
+			writeHistogram(w, f.name, t.name, f.value(t.counts))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP gocacheprog_upload_queue_depth Uploads waiting for a worker.\n# TYPE gocacheprog_upload_queue_depth gauge\n")
+	fmt.Fprintf(w, "gocacheprog_upload_queue_depth %d\n", len(m.s3.work))
+
+	files, size := m.diskSize()
+	fmt.Fprintf(w, "# HELP gocacheprog_disk_cache_files Files in the local cache dir.\n# TYPE gocacheprog_disk_cache_files gauge\n")
+	fmt.Fprintf(w, "gocacheprog_disk_cache_files %d\n", files)
+	fmt.Fprintf(w, "# HELP gocacheprog_disk_cache_bytes Size of the local cache dir.\n# TYPE gocacheprog_disk_cache_bytes gauge\n")
+	fmt.Fprintf(w, "gocacheprog_disk_cache_bytes %d\n", size)
+}
+
+var histogramFamilies = []struct {
+	name, help string
+	value      func(*Counts) histogramSnapshot
+}{
+	{"gocacheprog_get_duration_seconds", "Latency of gets.", func(c *Counts) histogramSnapshot { return c.getLatency.snapshot() }},
+	{"gocacheprog_put_duration_seconds", "Latency of puts.", func(c *Counts) histogramSnapshot { return c.putLatency.snapshot() }},
+	{"gocacheprog_get_size_bytes", "Size of objects gotten.", func(c *Counts) histogramSnapshot { return c.getSizes.snapshot() }},
+	{"gocacheprog_put_size_bytes", "Size of objects put.", func(c *Counts) histogramSnapshot { return c.putSizes.snapshot() }},
+}
+
+func writeHistogram(w io.Writer, name, tier string, s histogramSnapshot) {
+	for i, b := range s.Bounds {
+		fmt.Fprintf(w, "%s_bucket{tier=%q,le=%q} %d\n", name, tier, strconv.FormatFloat(b, 'g', -1, 64), s.Cumulative[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{tier=%q,le=\"+Inf\"} %d\n", name, tier, s.Count)
+	fmt.Fprintf(w, "%s_sum{tier=%q} %g\n", name, tier, s.Sum)
+	fmt.Fprintf(w, "%s_count{tier=%q} %d\n", name, tier, s.Count)
+}
+
+// diskSize returns the number of files in and size of the local cache dir, at most sizeMaxAge old.
+func (m *metricsServer) diskSize() (int64, int64) {
+	m.sizeMu.Lock()
+	defer m.sizeMu.Unlock()
+	if time.Since(m.sizeAt) < m.sizeMaxAge {
+		return m.diskFiles, m.diskBytes
+	}
+	var files, size int64
+	_ = filepath.WalkDir(m.disk.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			files++
+			size += fi.Size()
+		}
+		return nil
+	})
+	m.diskFiles, m.diskBytes, m.sizeAt = files, size, time.Now()
+	return files, size
+}
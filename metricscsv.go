@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// csvTimestampFormat is a timestamp that spreadsheets (Google Sheets, at least) parse
+const csvTimestampFormat = "2006-01-02 15:04:05.000"
+
+// metricsCSV writes the counts of the disk and S3 tiers to a CSV file, one row per tier, at every interval and on
+// Close. The counts are cumulative; the queue depth and in-flight columns are as of the row's timestamp. Without an
+// interval, it writes the one row of S3 counts on Close that it always has, for the scripts that read it.
+type metricsCSV struct {
+	f     *os.File
+	disk  *DiskCache
+	s3    *DiskAsyncS3Cache
+	procs *processStats
+	// oneShot is set without an interval
+	oneShot bool
+
+	mu sync.Mutex // guards w
+	w  *csv.Writer
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startMetricsCSV(file string, interval time.Duration, disk *DiskCache, s3 *DiskAsyncS3Cache, procs *processStats) (*metricsCSV, error) {
+	f, err := os.Create(file)
+	if err != nil {
+		return nil, err
+	}
+	m := &metricsCSV{
+		f:     f,
+		w:     csv.NewWriter(f),
+		disk:  disk,
+		s3:    s3,
+		procs: procs,
+		stop:  make(chan struct{}),
+	}
+	header := append([]string{"timestamp", "tier", "queueDepth", "getsInFlight", "putsInFlight", "getsWaiting", "putsWaiting"}, countsCSVHeader...)
+	if interval <= 0 {
+		m.oneShot = true
+		header = countsCSVHeader
+	}
+	if err := m.w.Write(header); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !m.oneShot {
+		m.wg.Add(1)
+		go m.loop(interval)
+	}
+	return m, nil
+}
+
+func (m *metricsCSV) loop(interval time.Duration) {
+	defer m.wg.Done()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			if err := m.writeRows(now); err != nil {
+				slog.Error("failed to write metrics", "err", err)
+				return
+			}
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// writeRows writes a row per tier, and flushes them so they can be watched as the file grows.
+func (m *metricsCSV) writeRows(now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.oneShot {
+		if err := m.w.Write(m.s3.Counts.csvRecord()); err != nil {
+			return err
+		}
+		m.w.Flush()
+		return m.w.Error()
+	}
+	f := m.procs.inFlight()
+	common := []string{
+		now.UTC().Format(csvTimestampFormat),
+		"",
+		strconv.Itoa(len(m.s3.work)),
+		strconv.FormatInt(f.Gets, 10),
+		strconv.FormatInt(f.Puts, 10),
+		strconv.FormatInt(f.GetsWaiting, 10),
+		strconv.FormatInt(f.PutsWaiting, 10),
+	}
+	tiers := []struct {
+		name   string
+		counts *Counts
+	}{
+		{"disk", &m.disk.Counts},
+		{"s3", &m.s3.Counts},
+	}
+	for _, t := range tiers {
+		common[1] = t.name
+		if err := m.w.Write(append(common, t.counts.csvRecord()...)); err != nil {
+			return err
+		}
+	}
+	m.w.Flush()
+	return m.w.Error()
+}
+
+// Close writes the final rows and closes the file.
+func (m *metricsCSV) Close() error {
+	close(m.stop)
+	m.wg.Wait()
+	err := m.writeRows(time.Now())
+	if cErr := m.f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func readCSV(t *testing.T, file string) [][]string {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestMetricsCSV(t *testing.T) {
+	disk := NewDiskCache(t.TempDir())
+	s3 := NewDiskAsyncS3Cache(disk, newFakeS3(), "bucket", "p", 1, 1)
+	s3.Counts.gets.Add(3)
+
+	t.Run("one shot", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "metrics.csv")
+		m, err := startMetricsCSV(file, 0, disk, s3, &processStats{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		records := readCSV(t, file)
+		if len(records) != 2 || !slices.Equal(records[0], countsCSVHeader) {
+			t.Fatalf("got %q, want the counts header and one row", records)
+		}
+		if records[1][0] != "3" {
+			t.Errorf("gets = %s, want the s3 tier's 3", records[1][0])
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "metrics.csv")
+		m, err := startMetricsCSV(file, time.Hour, disk, s3, &processStats{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.Close(); err != nil {
+			t.Fatal(err)
+		}
+		records := readCSV(t, file)
+		if len(records) != 3 || records[0][0] != "timestamp" || records[0][1] != "tier" {
+			t.Fatalf("got %q, want a timestamped header and a row per tier", records)
+		}
+		if records[1][1] != "disk" || records[2][1] != "s3" {
+			t.Errorf("tiers %s and %s, want disk and s3", records[1][1], records[2][1])
+		}
+	})
+}
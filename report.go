@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/cacheproc"
+)
+
+// statsReport is what -stats-json writes at exit, for CI to collect.
+type statsReport struct {
+	Mode        string                  `json:"mode"`
+	Error       string                  `json:"error,omitempty"`
+	Start       time.Time               `json:"start"`
+	End         time.Time               `json:"end"`
+	WallSeconds float64                 `json:"wallSeconds"`
+	Config      configReport            `json:"config"`
+	Toolchain   toolchainReport         `json:"toolchain"`
+	CacheProc   processReport           `json:"cacheproc"`
+	Queue       queueReport             `json:"queue"`
+	Tiers       map[string]countsReport `json:"tiers"`
+}
+
+type configReport struct {
+	Bucket             string  `json:"bucket"`
+	Prefix             string  `json:"prefix"`
+	LocalCacheDir      string  `json:"localCacheDir"`
+	Compression        string  `json:"compression"`
+	CompressionMinSize int64   `json:"compressionMinSize"`
+	DiskCompression    string  `json:"diskCompression"`
+	SkipExisting       bool    `json:"skipExisting"`
+	Manifest           string  `json:"manifest,omitempty"`
+	Prefetch           bool    `json:"prefetch"`
+	Coaccess           bool    `json:"coaccess"`
+	Backfill           bool    `json:"backfill"`
+	BackfillRate       float64 `json:"backfillRate"`
+	MaxConcurrentGets  int     `json:"maxConcurrentGets"`
+	MaxConcurrentPuts  int     `json:"maxConcurrentPuts"`
+}
+
+type toolchainReport struct {
+	GoVersion string `json:"goVersion"`
+	GOOS      string `json:"goos"`
+	GOARCH    string `json:"goarch"`
+	Module    string `json:"module,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Revision  string `json:"revision,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+}
+
+func newToolchainReport() toolchainReport {
+	r := toolchainReport{
+		GoVersion: runtime.Version(),
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return r
+	}
+	r.Module = bi.Main.Path
+	r.Version = bi.Main.Version
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			r.Revision = s.Value
+		case "vcs.modified":
+			r.Modified = s.Value == "true"
+		}
+	}
+	return r
+}
+
+// processReport totals the counters of the cacheproc.Processes that served cmd/go; the daemon has one per client.
+type processReport struct {
+	Clients        int64   `json:"clients"`
+	Gets           int64   `json:"gets"`
+	GetHits        int64   `json:"getHits"`
+	GetMisses      int64   `json:"getMisses"`
+	GetErrors      int64   `json:"getErrors"`
+	Puts           int64   `json:"puts"`
+	PutErrors      int64   `json:"putErrors"`
+	MaxGetsWaiting int64   `json:"maxGetsWaiting"`
+	GetWaitSeconds float64 `json:"getWaitSeconds"`
+	MaxPutsWaiting int64   `json:"maxPutsWaiting"`
+	PutWaitSeconds float64 `json:"putWaitSeconds"`
+}
+
+// processStats keeps track of the processes serving cmd/go, and accumulates a processReport as they finish.
+type processStats struct {
+	mu     sync.Mutex
+	live   map[*cacheproc.Process]bool
+	report processReport
+}
+
+// start tracks p while it serves.
+func (s *processStats) start(p *cacheproc.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.live == nil {
+		s.live = make(map[*cacheproc.Process]bool)
+	}
+	s.live[p] = true
+}
+
+// done adds the counters of p, which has finished serving, to the totals.
+func (s *processStats) done(p *cacheproc.Process) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.live, p)
+	r := &s.report
+	r.Clients++
+	r.Gets += p.Gets.Load()
+	r.GetHits += p.GetHits.Load()
+	r.GetMisses += p.GetMisses.Load()
+	r.GetErrors += p.GetErrors.Load()
+	r.Puts += p.Puts.Load()
+	r.PutErrors += p.PutErrors.Load()
+	r.MaxGetsWaiting = max(r.MaxGetsWaiting, p.MaxGetsWaiting.Load())
+	r.GetWaitSeconds += time.Duration(p.GetWaitNanos.Load()).Seconds()
+	r.MaxPutsWaiting = max(r.MaxPutsWaiting, p.MaxPutsWaiting.Load())
+	r.PutWaitSeconds += time.Duration(p.PutWaitNanos.Load()).Seconds()
+}
+
+// inFlight is what the live processes are doing right now.
+type inFlight struct {
+	Gets, Puts               int64
+	GetsWaiting, PutsWaiting int64
+}
+
+func (s *processStats) inFlight() inFlight {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var f inFlight
+	for p := range s.live {
+		f.Gets += p.GetsInFlight.Load()
+		f.Puts += p.PutsInFlight.Load()
+		f.GetsWaiting += p.GetsWaiting.Load()
+		f.PutsWaiting += p.PutsWaiting.Load()
+	}
+	return f
+}
+
+func (s *processStats) snapshot() processReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+// queueReport describes the S3 upload queue.
+type queueReport struct {
+	Capacity    int     `json:"capacity"`
+	Workers     int     `json:"workers"`
+	Depth       int     `json:"depth"`
+	MaxDepth    int64   `json:"maxDepth"`
+	WaitSeconds float64 `json:"waitSeconds"`
+}
+
+func (c *DiskAsyncS3Cache) queueReport() queueReport {
+	return queueReport{
+		Capacity:    cap(c.work),
+		Workers:     c.nWorkers,
+		Depth:       len(c.work),
+		MaxDepth:    c.maxQueueDepth.Load(),
+		WaitSeconds: time.Duration(c.queueWaitNanos.Load()).Seconds(),
+	}
+}
+
+// countsReport is a Counts in the stats report.
+type countsReport struct {
+	Gets             int64              `json:"gets"`
+	Hits             int64              `json:"hits"`
+	Misses           int64              `json:"misses"`
+	Coalesced        int64              `json:"coalesced"`
+	GetErrors        int64              `json:"getErrors"`
+	Puts             int64              `json:"puts"`
+	Deduped          int64              `json:"deduped"`
+	Skipped          int64              `json:"skipped"`
+	PutErrors        int64              `json:"putErrors"`
+	TotalGetBytes    int64              `json:"totalGetBytes"`
+	TotalGetRawBytes int64              `json:"totalGetRawBytes"`
+	TotalGetSeconds  float64            `json:"totalGetSeconds"`
+	TotalPutBytes    int64              `json:"totalPutBytes"`
+	TotalPutRawBytes int64              `json:"totalPutRawBytes"`
+	TotalPutSeconds  float64            `json:"totalPutSeconds"`
+	GetLatency       distributionReport `json:"getLatencySeconds"`
+	PutLatency       distributionReport `json:"putLatencySeconds"`
+	GetSizes         distributionReport `json:"getSizeBytes"`
+	PutSizes         distributionReport `json:"putSizeBytes"`
+}
+
+func (c *Counts) report() countsReport {
+	return countsReport{
+		Gets:             c.gets.Load(),
+		Hits:             c.hits.Load(),
+		Misses:           c.misses.Load(),
+		Coalesced:        c.coalesced.Load(),
+		GetErrors:        c.getErrors.Load(),
+		Puts:             c.puts.Load(),
+		Deduped:          c.deduped.Load(),
+		Skipped:          c.skipped.Load(),
+		PutErrors:        c.putErrors.Load(),
+		TotalGetBytes:    c.totalGetBytes.Load(),
+		TotalGetRawBytes: c.totalGetRawBytes.Load(),
+		TotalGetSeconds:  c.totalGetDur.Load().Seconds(),
+		TotalPutBytes:    c.totalPutBytes.Load(),
+		TotalPutRawBytes: c.totalPutRawBytes.Load(),
+		TotalPutSeconds:  c.totalPutDur.Load().Seconds(),
+		GetLatency:       newDistributionReport(c.getLatency.snapshot()),
+		PutLatency:       newDistributionReport(c.putLatency.snapshot()),
+		GetSizes:         newDistributionReport(c.getSizes.snapshot()),
+		PutSizes:         newDistributionReport(c.putSizes.snapshot()),
+	}
+}
+
+type distributionReport struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func newDistributionReport(s histogramSnapshot) distributionReport {
+	return distributionReport{
+		Count: s.Count,
+		Sum:   s.Sum,
+		P50:   s.Quantile(0.5),
+		P90:   s.Quantile(0.9),
+		P99:   s.Quantile(0.99),
+		Max:   s.Max,
+	}
+}
+
+func writeStatsReport(file string, r *statsReport) error {
+	b, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(b, '\n'), 0644)
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenPrivate listens on a unix socket at path that only we can connect to. The socket is created with a 0077
+// umask, rather than chmodded after, so there's no moment when anyone else could connect. The umask is process-wide,
+// so call it before starting anything else that creates files.
+func listenPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0077)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// runStats implements the stats subcommand, which summarizes the action objects in S3.
+func runStats(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	parallel := fs.Int("parallel", 16, "number of listings to run at once")
+	top := fs.Int("top", 10, "number of largest objects to show")
+	asJSON := fs.Bool("json", false, "write the stats as JSON")
+	fs.Parse(args)
+
+	start := time.Now()
+	st, err := cacher.BucketStats(ctx, *parallel, *top)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(st)
+	}
+	w := os.Stdout
+	fmt.Fprintf(w, "s3://%s/%s: %d objects, %s (listed in %s)\n", st.Bucket, st.Prefix, st.Objects, formatBytes(float64(st.Bytes)),
+		time.Since(start).Round(100*time.Millisecond))
+	if st.Objects == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "size: p50 %s, p90 %s, p99 %s, max %s\n", formatBytes(st.Sizes.P50), formatBytes(st.Sizes.P90),
+		formatBytes(st.Sizes.P99), formatBytes(st.Sizes.Max))
+	fmt.Fprintf(w, "last modified: oldest %s, newest %s\n", st.Oldest.Format(time.RFC3339), st.Newest.Format(time.RFC3339))
+	fmt.Fprintf(w, "\nage:\n")
+	for _, a := range st.Ages {
+		fmt.Fprintf(w, "  %-8s %8d objects (%5.1f%%) %10s (%5.1f%%)\n", a.Name, a.Count, percent(int(a.Count), int(st.Objects)),
+			formatBytes(float64(a.Bytes)), percent(int(a.Bytes), int(st.Bytes)))
+	}
+	if len(st.Largest) > 0 {
+		fmt.Fprintf(w, "\nlargest:\n")
+		for _, o := range st.Largest {
+			fmt.Fprintf(w, "  %10s  %s  %s\n", formatBytes(float64(o.Size)), o.LastModified.Format(time.DateOnly), path.Base(o.Key))
+		}
+	}
+	return nil
+}
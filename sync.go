@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runSync implements the sync subcommand, which backfills S3 with the local cache entries that are missing from it.
+func runSync(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only report which entries are missing from s3")
+	rate := fs.Float64("rate", 0, "max entries checked in s3 (and uploaded) per second (0=unlimited)")
+	fs.Parse(args)
+
+	if err := cacher.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start cache: %w", err)
+	}
+	res, err := cacher.Backfill(ctx, BackfillOptions{DryRun: *dryRun, RateLimit: *rate})
+	// Close waits for the queued uploads
+	if closeErr := cacher.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "sync: %d entries scanned, %d missing from s3, %d queued for upload\n", res.Scanned, res.Missing, res.Queued)
+	return nil
+}
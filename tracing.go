@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/nfi-hashicorp/gocacheprog-s3/go-tool-cache/wire"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is a no-op until setupTracing installs a real tracer provider, so spans are cheap when tracing is off.
+var tracer = otel.Tracer("github.com/nfi-hashicorp/gocacheprog-s3")
+
+// setupTracing exports spans over OTLP/HTTP to endpoint (a URL like http://localhost:4318) and/or as JSON to file.
+// The returned func flushes and stops the exporters.
+func setupTracing(ctx context.Context, endpoint, file string) (func(context.Context) error, error) {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", "gocacheprog-s3")))
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	var closeFile func() error
+	if endpoint != "" {
+		exp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+		if err != nil {
+			return nil, fmt.Errorf("otlp exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	if file != "" {
+		f, err := os.Create(file)
+		if err != nil {
+			return nil, fmt.Errorf("trace file: %w", err)
+		}
+		closeFile = f.Close
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("file exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closeFile != nil {
+			err = errors.Join(err, closeFile())
+		}
+		return err
+	}, nil
+}
+
+// startRequestSpan is a cacheproc.Process StartRequest that starts a span for each request.
+func startRequestSpan(ctx context.Context, req *wire.Request) (context.Context, func(*wire.Response, error)) {
+	ctx, span := tracer.Start(ctx, "cacheproc."+string(req.Command), trace.WithAttributes(
+		attribute.Int64("cacheproc.request_id", req.ID),
+		attribute.String("cacheproc.command", string(req.Command)),
+	))
+	if req.ActionID != nil {
+		span.SetAttributes(attribute.String("cacheproc.action_id", fmt.Sprintf("%x", req.ActionID)))
+	}
+	if req.Command == wire.CmdPut {
+		span.SetAttributes(
+			attribute.String("cacheproc.output_id", fmt.Sprintf("%x", req.OutputID)),
+			attribute.Int64("cacheproc.size", req.BodySize),
+		)
+	}
+	return ctx, func(res *wire.Response, err error) {
+		if req.Command == wire.CmdGet {
+			span.SetAttributes(attribute.Bool("cacheproc.miss", res.Miss))
+			if !res.Miss && err == nil {
+				span.SetAttributes(
+					attribute.String("cacheproc.output_id", fmt.Sprintf("%x", res.OutputID)),
+					attribute.Int64("cacheproc.size", res.Size),
+				)
+			}
+		}
+		endSpan(span, err)
+	}
+}
+
+// setTier records which tier served a get on the request's span and access record.
+func setTier(ctx context.Context, tier string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("gocacheprog.tier", tier))
+	if r := accessRecordFrom(ctx); r != nil {
+		r.Tier = tier
+	}
+}
+
+// endSpan ends span, marking it as failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"golang.org/x/sync/errgroup"
+)
+
+// quarantinePath is where verify -fix=quarantine moves bad objects under the s3 prefix. Nothing reads from it.
+const quarantinePath = "_quarantine"
+
+// verifyFix is what verify does with the bad entries it finds.
+type verifyFix string
+
+const (
+	fixNone       verifyFix = ""
+	fixQuarantine verifyFix = "quarantine"
+	fixDelete     verifyFix = "delete"
+)
+
+func parseVerifyFix(s string) (verifyFix, error) {
+	switch f := verifyFix(s); f {
+	case fixNone, fixQuarantine, fixDelete:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown fix %q (want quarantine or delete)", s)
+}
+
+// verifyProblem is something wrong with a file in the disk cache or an object in S3.
+type verifyProblem struct {
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	// Fixed is what was done about it: "quarantine" or "delete", if it worked
+	Fixed verifyFix `json:"fixed,omitempty"`
+}
+
+// VerifyResult is what a verify of one tier found.
+type VerifyResult struct {
+	// Entries is the number of index entries or action objects checked, out of Listed objects in S3
+	Entries int64 `json:"entries"`
+	Listed  int64 `json:"listed,omitempty"`
+	Outputs int64 `json:"outputs,omitempty"`
+	// Unverifiable is the number of outputs checked whose outputID isn't a SHA-256, so only their size was checked
+	Unverifiable int64           `json:"unverifiable,omitempty"`
+	Problems     []verifyProblem `json:"problems"`
+}
+
+// unfixed is the number of problems left as they were.
+func (r *VerifyResult) unfixed() int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Fixed == fixNone {
+			n++
+		}
+	}
+	return n
+}
+
+// validID reports whether id looks like an actionID or outputID: hex. cmd/go uses SHA-256 today, but the protocol
+// doesn't say which hash, so any length will do.
+func validID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && id != ""
+}
+
+// verifiable reports whether outputID is as long as the hash hashOutput computes, so an output can be checked against
+// it. Other outputs aren't corrupt, just unverifiable.
+func verifiable(outputID string) bool {
+	return len(outputID) == 2*sha256.Size
+}
+
+// hashOutput reads an output, returning its size and the SHA-256 of its contents, which is its outputID if it's
+// [verifiable].
+func hashOutput(r io.Reader) (int64, string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return n, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Verify checks every output file (hot or cold) in the disk cache against its outputID, then every index entry: that
+// it's valid JSON with a valid outputID, and that its output is there, intact, and of the size it says. Bad files are
+// quarantined or deleted if fix says so; an action whose output is bad goes too, since Get would miss on it anyway.
+func (c *DiskCache) Verify(fix verifyFix) (*VerifyResult, error) {
+	res := &VerifyResult{Problems: []verifyProblem{}}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	// sizes of the intact outputs, and the outputIDs of the bad ones
+	sizes := make(map[string]int64)
+	bad := make(map[string]bool)
+	for _, e := range entries {
+		rest, ok := strings.CutPrefix(e.Name(), "o-")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		outputID, compression := rest, CompressionNone
+		for _, cmp := range []Compression{CompressionZstd, CompressionGzip} {
+			if id, ok := strings.CutSuffix(rest, cmp.Ext()); ok {
+				outputID, compression = id, cmp
+			}
+		}
+		// skips temp files
+		if _, err := hex.DecodeString(outputID); err != nil {
+			continue
+		}
+		res.Outputs++
+		size, problem := c.verifyOutput(e.Name(), outputID, compression)
+		if size < 0 {
+			continue
+		}
+		if problem == "" {
+			sizes[outputID] = size
+			if !verifiable(outputID) {
+				res.Unverifiable++
+			}
+			continue
+		}
+		bad[outputID] = true
+		res.Problems = append(res.Problems, c.fixProblem(e.Name(), problem, "o-"+outputID, fix))
+	}
+
+	for _, e := range entries {
+		actionID, ok := strings.CutPrefix(e.Name(), "a-")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		if _, err := hex.DecodeString(actionID); err != nil {
+			continue
+		}
+		res.Entries++
+		problem := c.verifyEntry(actionID, sizes, bad)
+		if problem != "" {
+			res.Problems = append(res.Problems, c.fixProblem(e.Name(), problem, "a-"+actionID, fix))
+		}
+	}
+	return res, nil
+}
+
+// verifyOutput checks the output file name, returning its uncompressed size (-1 if it's gone), or what's wrong with it.
+func (c *DiskCache) verifyOutput(name, outputID string, compression Compression) (int64, string) {
+	if !validID(outputID) {
+		return 0, "not a valid outputID"
+	}
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if os.IsNotExist(err) {
+		// it was compressed or decompressed while we weren't looking; we'll see the other copy
+		return -1, ""
+	} else if err != nil {
+		return 0, err.Error()
+	}
+	defer f.Close()
+	r, err := compression.NewReader(f)
+	if err != nil {
+		return 0, fmt.Sprintf("decompressing: %v", err)
+	}
+	defer r.Close()
+	size, sum, err := hashOutput(r)
+	if err != nil {
+		return 0, fmt.Sprintf("reading: %v", err)
+	}
+	if verifiable(outputID) && sum != outputID {
+		return 0, fmt.Sprintf("contents hash to %s", sum)
+	}
+	return size, ""
+}
+
+// verifyEntry checks the index entry of actionID against the outputs checked, returning what's wrong with it.
+func (c *DiskCache) verifyEntry(actionID string, sizes map[string]int64, bad map[string]bool) string {
+	ij, err := os.ReadFile(c.actionFile(actionID))
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		return err.Error()
+	}
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return fmt.Sprintf("bad index JSON: %v", err)
+	}
+	if !validID(ie.OutputID) {
+		return fmt.Sprintf("bad outputID %q", ie.OutputID)
+	}
+	if bad[ie.OutputID] {
+		return fmt.Sprintf("output %s is bad", ie.OutputID)
+	}
+	size, ok := sizes[ie.OutputID]
+	if !ok {
+		return fmt.Sprintf("output %s is missing", ie.OutputID)
+	}
+	if size != ie.Size {
+		return fmt.Sprintf("index says %d bytes, output has %d", ie.Size, size)
+	}
+	return ""
+}
+
+// quarantineDir is where verify -fix=quarantine moves bad files. Nothing reads from it.
+func (c *DiskCache) quarantineDir() string {
+	return filepath.Join(c.dir, "quarantine")
+}
+
+// fixProblem quarantines or deletes the file name, under lockName, if fix says so.
+func (c *DiskCache) fixProblem(name, problem, lockName string, fix verifyFix) verifyProblem {
+	p := verifyProblem{Key: name, Problem: problem}
+	c.log.Debug("verify: "+problem, "file", name)
+	if fix == fixNone {
+		return p
+	}
+	unlock, err := c.lock(lockName)
+	if err != nil {
+		c.log.Error("verify: fixing", "file", name, "err", err)
+		return p
+	}
+	defer unlock()
+	file := filepath.Join(c.dir, name)
+	switch fix {
+	case fixQuarantine:
+		if err = os.MkdirAll(c.quarantineDir(), 0755); err == nil {
+			err = os.Rename(file, filepath.Join(c.quarantineDir(), name))
+		}
+	case fixDelete:
+		err = os.Remove(file)
+	}
+	if err != nil {
+		c.log.Error("verify: fixing", "file", name, "err", err)
+		return p
+	}
+	p.Fixed = fix
+	return p
+}
+
+// Verify gets a random sample (a fraction from 0 to 1) of the action objects in S3, up to parallel at once, and checks
+// that their metadata is valid and their contents match it: size and outputID. Bad objects are quarantined (moved
+// under <prefix>/_quarantine/) or deleted if fix says so. It doesn't need [Start].
+func (c *DiskAsyncS3Cache) Verify(ctx context.Context, sample float64, parallel int, fix verifyFix) (*VerifyResult, error) {
+	res := &VerifyResult{Problems: []verifyProblem{}}
+	var keys []string
+	var mu sync.Mutex
+	err := c.listActions(ctx, parallel, func(o remoteObject) error {
+		mu.Lock()
+		defer mu.Unlock()
+		res.Listed++
+		if rand.Float64() < sample {
+			keys = append(keys, o.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(max(parallel, 1))
+	for _, key := range keys {
+		g.Go(func() error {
+			problem, unverifiable, err := c.verifyObject(gctx, key)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			res.Entries++
+			if unverifiable {
+				res.Unverifiable++
+			}
+			if problem != "" {
+				c.log.Debug("verify: "+problem, "key", key)
+				res.Problems = append(res.Problems, verifyProblem{Key: key, Problem: problem})
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return res, err
+	}
+	if fix != fixNone {
+		err = c.fixProblems(ctx, res.Problems, fix)
+	}
+	return res, err
+}
+
+// verifyObject gets key and returns what's wrong with it, or an error if we couldn't tell. unverifiable is true if its
+// outputID isn't a SHA-256, so only its size could be checked.
+func (c *DiskAsyncS3Cache) verifyObject(ctx context.Context, key string) (problem string, unverifiable bool, err error) {
+	out, err := c.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &c.bucketName,
+		Key:    &key,
+	})
+	if isS3NotFoundError(err) {
+		// deleted since we listed it
+		return "", false, nil
+	} else if err != nil {
+		return "", false, fmt.Errorf("getting %s: %w", key, err)
+	}
+	obj, err := c.decodeObject(key, out)
+	if err != nil {
+		return err.Error(), false, nil
+	}
+	defer obj.Body.Close()
+	if !validID(obj.OutputID) {
+		return fmt.Sprintf("bad outputID %q in metadata", obj.OutputID), false, nil
+	}
+	size, sum, err := hashOutput(obj.Body)
+	if err != nil {
+		return fmt.Sprintf("reading: %v", err), false, nil
+	}
+	if size != obj.Size {
+		return fmt.Sprintf("metadata says %d bytes, contents have %d", obj.Size, size), false, nil
+	}
+	if !verifiable(obj.OutputID) {
+		return "", true, nil
+	}
+	if sum != obj.OutputID {
+		return fmt.Sprintf("contents hash to %s, not outputID %s", sum, obj.OutputID), false, nil
+	}
+	return "", false, nil
+}
+
+// fixProblems quarantines or deletes the objects with problems, marking the ones it fixed.
+func (c *DiskAsyncS3Cache) fixProblems(ctx context.Context, problems []verifyProblem, fix verifyFix) error {
+	var keys []string
+	var fixed []*verifyProblem
+	var errs []error
+	for i := range problems {
+		p := &problems[i]
+		if fix == fixQuarantine {
+			dest := fmt.Sprintf("%s/%s/%s", c.s3Prefix, quarantinePath, path.Base(p.Key))
+			_, err := c.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+				Bucket:     &c.bucketName,
+				Key:        &dest,
+				CopySource: aws.String(c.bucketName + "/" + p.Key),
+			})
+			if err != nil {
+				errs = append(errs, fmt.Errorf("quarantining %s: %w", p.Key, err))
+				continue
+			}
+		}
+		keys = append(keys, p.Key)
+		fixed = append(fixed, p)
+	}
+	n, err := c.deleteObjects(ctx, keys)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if n == int64(len(keys)) {
+		for _, p := range fixed {
+			p.Fixed = fix
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// runVerify implements the verify subcommand, which checks the disk cache and a sample of S3 for corrupt entries.
+func runVerify(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	disk := fs.Bool("disk", true, "check the whole disk cache")
+	sample := fs.Float64("sample", 0.01, "fraction of the objects in s3 to check (1=all, 0=none)")
+	fixFlag := fs.String("fix", "", "what to do with bad entries: quarantine or delete (default: nothing)")
+	parallel := fs.Int("parallel", 16, "number of listings and gets to run at once")
+	asJSON := fs.Bool("json", false, "write the results as JSON")
+	fs.Parse(args)
+	fix, err := parseVerifyFix(*fixFlag)
+	if err != nil {
+		return err
+	}
+
+	results := make(map[string]*VerifyResult)
+	if *disk {
+		// for the locks dir
+		if err := cacher.diskCache.Start(ctx); err != nil {
+			return err
+		}
+		defer cacher.diskCache.Close()
+		if results["disk"], err = cacher.diskCache.Verify(fix); err != nil {
+			return err
+		}
+	}
+	if *sample > 0 {
+		if results["s3"], err = cacher.Verify(ctx, *sample, *parallel, fix); err != nil {
+			return err
+		}
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	} else {
+		w := os.Stdout
+		if r := results["disk"]; r != nil {
+			fmt.Fprintf(w, "disk: %d index entries, %d outputs checked: %d problems\n", r.Entries, r.Outputs, len(r.Problems))
+			writeUnverifiable(w, r.Unverifiable)
+			writeProblems(w, r.Problems)
+		}
+		if r := results["s3"]; r != nil {
+			fmt.Fprintf(w, "s3: %d of %d objects checked: %d problems\n", r.Entries, r.Listed, len(r.Problems))
+			writeUnverifiable(w, r.Unverifiable)
+			writeProblems(w, r.Problems)
+		}
+	}
+	unfixed := 0
+	for _, r := range results {
+		unfixed += r.unfixed()
+	}
+	if unfixed > 0 {
+		return fmt.Errorf("verify: %d problems left unfixed", unfixed)
+	}
+	return nil
+}
+
+func writeUnverifiable(w io.Writer, n int64) {
+	if n > 0 {
+		fmt.Fprintf(w, "  %d outputs have outputIDs that aren't SHA-256s, so only their sizes were checked\n", n)
+	}
+}
+
+func writeProblems(w io.Writer, problems []verifyProblem) {
+	for _, p := range problems {
+		if p.Fixed != fixNone {
+			fmt.Fprintf(w, "  %s: %s (%s)\n", p.Key, p.Problem, p.Fixed)
+		} else {
+			fmt.Fprintf(w, "  %s: %s\n", p.Key, p.Problem)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// outputOf returns the outputID and size of body, as cmd/go would make them.
+func outputOf(t *testing.T, body []byte) (string, int64) {
+	t.Helper()
+	size, outputID, err := hashOutput(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return outputID, size
+}
+
+func TestDiskVerifyFix(t *testing.T) {
+	id := func(i int) string { return fmt.Sprintf("%064x", i) }
+	for _, fix := range []verifyFix{fixQuarantine, fixDelete} {
+		t.Run(string(fix), func(t *testing.T) {
+			ctx := context.Background()
+			dc := NewDiskCache(t.TempDir())
+			if err := dc.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			defer dc.Close()
+			put := func(actionID, outputID string, body []byte) {
+				t.Helper()
+				ie := indexEntry{Version: 1, OutputID: outputID, Size: int64(len(body)), TimeNanos: time.Now().UnixNano()}
+				if err := dc.putEntry(actionID, ie, bytes.NewReader(body)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			good, _ := outputOf(t, []byte("good"))
+			put(id(1), good, []byte("good"))
+			corrupt, _ := outputOf(t, []byte("corrupt"))
+			put(id(2), corrupt, []byte("corrupt"))
+			if err := os.Remove(dc.outputFile(corrupt)); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(dc.outputFile(corrupt), []byte("CORRUPT"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// from some other hash, which verify can't check
+			put(id(3), "abcd0123", []byte("other"))
+
+			res, err := dc.Verify(fix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Entries != 3 || res.Outputs != 3 || res.Unverifiable != 1 {
+				t.Errorf("got %+v, want 3 entries, 3 outputs, 1 unverifiable", res)
+			}
+			var keys []string
+			for _, p := range res.Problems {
+				if p.Fixed != fix {
+					t.Errorf("%s: fixed %q, want %q", p.Key, p.Fixed, fix)
+				}
+				keys = append(keys, p.Key)
+			}
+			bad := []string{"a-" + id(2), "o-" + corrupt}
+			slices.Sort(keys)
+			if !slices.Equal(keys, bad) {
+				t.Errorf("problems with %v, want %v", keys, bad)
+			}
+
+			for _, name := range bad {
+				if _, err := os.Stat(filepath.Join(dc.dir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s left in the cache: %v", name, err)
+				}
+				_, err := os.Stat(filepath.Join(dc.quarantineDir(), name))
+				if quarantined := err == nil; quarantined != (fix == fixQuarantine) {
+					t.Errorf("%s quarantined = %v with fix %s", name, quarantined, fix)
+				}
+			}
+			for _, actionID := range []string{id(1), id(3)} {
+				if outputID, _, err := dc.Get(ctx, actionID); err != nil || outputID == "" {
+					t.Errorf("Get(%s) = %q, %v after the fix; want a hit", actionID, outputID, err)
+				}
+			}
+			if res, err := dc.Verify(fixNone); err != nil || len(res.Problems) != 0 {
+				t.Errorf("verify after the fix: %+v, %v", res, err)
+			}
+		})
+	}
+}
+
+func TestS3VerifyFix(t *testing.T) {
+	id := func(i int) string { return fmt.Sprintf("%064x", i) }
+	newBucket := func() *fakeS3 {
+		f := newFakeS3()
+		now := time.Now()
+		object := func(body []byte, outputID string) fakeObject {
+			return fakeObject{body: body, metadata: map[string]string{outputIDMetadataKey: outputID}, lastModified: now}
+		}
+		good, _ := outputOf(t, []byte("good"))
+		f.objects["p/"+id(1)] = object([]byte("good"), good)
+		corrupt, _ := outputOf(t, []byte("corrupt"))
+		f.objects["p/"+id(2)] = object([]byte("CORRUPT"), corrupt)
+		f.objects["p/"+id(3)] = object([]byte("other"), "abcd0123")
+		// no metadata
+		f.objects["p/"+id(4)] = fakeObject{body: []byte("good"), lastModified: now}
+		// compressed, but smaller than its metadata says
+		var buf bytes.Buffer
+		w, err := CompressionGzip.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("good"))
+		w.Close()
+		f.objects["p/"+id(5)] = fakeObject{
+			body: buf.Bytes(),
+			metadata: map[string]string{
+				outputIDMetadataKey:    good,
+				compressionMetadataKey: string(CompressionGzip),
+				rawSizeMetadataKey:     strconv.Itoa(len("good") + 1),
+			},
+			lastModified: now,
+		}
+		return f
+	}
+	bad := []string{"p/" + id(2), "p/" + id(4), "p/" + id(5)}
+
+	for _, fix := range []verifyFix{fixQuarantine, fixDelete} {
+		t.Run(string(fix), func(t *testing.T) {
+			f := newBucket()
+			c := NewDiskAsyncS3Cache(nil, f, "bucket", "p", 1, 1)
+			res, err := c.Verify(context.Background(), 1, 4, fix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Listed != 5 || res.Entries != 5 || res.Unverifiable != 1 {
+				t.Errorf("got %+v, want 5 listed and checked, 1 unverifiable", res)
+			}
+			var keys []string
+			for _, p := range res.Problems {
+				if p.Fixed != fix {
+					t.Errorf("%s: fixed %q, want %q", p.Key, p.Fixed, fix)
+				}
+				keys = append(keys, p.Key)
+			}
+			slices.Sort(keys)
+			if !slices.Equal(keys, bad) {
+				t.Errorf("problems with %v, want %v", keys, bad)
+			}
+
+			want := []string{"p/" + id(1), "p/" + id(3)}
+			if fix == fixQuarantine {
+				for _, key := range bad {
+					want = append(want, "p/"+quarantinePath+"/"+key[len("p/"):])
+				}
+			}
+			slices.Sort(want)
+			if got := f.keys(); !slices.Equal(got, want) {
+				t.Errorf("left %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// runWarm implements the warm subcommand, which fills the disk cache with the entries in a manifest.
+func runWarm(ctx context.Context, cacher *DiskAsyncS3Cache, args []string) error {
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	manifest := fs.String("manifest", *flagManifest, "name of the manifest to warm from")
+	workers := fs.Int("workers", *flagPrefetchWorkers, "number of parallel downloads")
+	fs.Parse(args)
+	if *manifest == "" {
+		return errors.New("warm: no manifest; set -manifest")
+	}
+
+	if err := cacher.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start cache: %w", err)
+	}
+	res, err := cacher.WarmFromManifest(ctx, *manifest, *workers)
+	if closeErr := cacher.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "warm: %d actions in manifest: %d already local, %d fetched, %d missing from s3, %d errors\n",
+		res.Requested, res.Local, res.Fetched, res.Missing, res.Errors)
+	return nil
+}